@@ -0,0 +1,195 @@
+//
+//  Copyright (C) 2012-2016, Duzy Chan <code@duzy.info>, all rights reserverd.
+//
+package smart
+
+import (
+        "bytes"
+        "fmt"
+        "io"
+        "os"
+        "strconv"
+        "strings"
+        "time"
+)
+
+// Archive members are named like `lib.a(foo.o)` in targets and
+// prerequisites, `lib.a(foo.o bar.o)` names each of the members. The
+// modification time of a member is the one recorded in the `ar` archive, so
+// rules like this update only members older than the objects:
+//
+//      lib.a: lib.a(foo.o) lib.a(bar.o)
+//      lib.a(%.o): %.o
+//              ar rU $@ $%
+//
+// Archives written by `ar` in deterministic mode (`D`, the default of
+// some distributions) record zero times, and members are always updated.
+
+const archiveMagic = "!<arch>\n"
+
+// splitArchiveMember splits the name like `lib.a(foo.o)` into the archive
+// and the member.
+func splitArchiveMember(name string) (archive, member string, ok bool) {
+        if n := len(name); 2 < n && name[n-1] == ')' {
+                if i := strings.Index(name, "("); 0 < i && i < n-2 {
+                        archive, member, ok = name[:i], name[i+1:n-1], true
+                }
+        }
+        return
+}
+
+// expandArchiveMembers expands names like `lib.a(foo.o bar.o)` (split into
+// `lib.a(foo.o` and `bar.o)`) into `lib.a(foo.o) lib.a(bar.o)`.
+func expandArchiveMembers(names []string) (result []string) {
+        for i := 0; i < len(names); i++ {
+                s := names[i]
+                p := strings.Index(s, "(")
+                if p <= 0 || strings.Contains(s[p:], ")") {
+                        result = append(result, s)
+                        continue
+                }
+                archive, members := s[:p], []string{ s[p+1:] }
+                for i+1 < len(names) {
+                        i++
+                        if t := names[i]; strings.HasSuffix(t, ")") {
+                                members = append(members, t[:len(t)-1])
+                                break
+                        } else {
+                                members = append(members, t)
+                        }
+                }
+                for _, m := range members {
+                        if m != "" {
+                                result = append(result, archive + "(" + m + ")")
+                        }
+                }
+        }
+        return
+}
+
+// memberNames returns the members of archive member names, other names are
+// kept.
+func memberNames(names []string) (result []string) {
+        for _, s := range names {
+                if _, member, ok := splitArchiveMember(s); ok {
+                        s = member
+                }
+                result = append(result, s)
+        }
+        return
+}
+
+// memberInfo describes an archive member.
+type memberInfo struct {
+        name string
+        size int64
+        mode os.FileMode
+        mtime time.Time
+}
+
+func (fi *memberInfo) Name() string { return fi.name }
+func (fi *memberInfo) Size() int64 { return fi.size }
+func (fi *memberInfo) Mode() os.FileMode { return fi.mode }
+func (fi *memberInfo) ModTime() time.Time { return fi.mtime }
+func (fi *memberInfo) IsDir() bool { return false }
+func (fi *memberInfo) Sys() interface{} { return nil }
+
+// statFile returns the file info of the file, or the archive member if the
+// name is like `lib.a(foo.o)`.
+func statFile(name string) (os.FileInfo, error) {
+        if archive, member, ok := splitArchiveMember(name); ok {
+                return statMember(archive, member)
+        }
+        return os.Stat(name)
+}
+
+// statMember looks up the member in the archive, the error satisfies
+// os.IsNotExist if the archive or the member is missing.
+func statMember(archive, member string) (os.FileInfo, error) {
+        f, err := os.Open(archive)
+        if err != nil {
+                return nil, err
+        }
+        defer f.Close()
+        fi, _, err := findMember(f, archive, member)
+        return fi, err
+}
+
+// touchMember sets the date of the member to the time, like `ar -u` does
+// when the member is replaced, the archive is touched too.
+func touchMember(archive, member string, t time.Time) error {
+        f, err := os.OpenFile(archive, os.O_RDWR, 0)
+        if err != nil {
+                return err
+        }
+        _, pos, err := findMember(f, archive, member)
+        if err == nil {
+                _, err = f.WriteAt([]byte(fmt.Sprintf("%-12d", t.Unix())), pos + 16)
+        }
+        if e := f.Close(); err == nil {
+                err = e
+        }
+        if err == nil {
+                err = os.Chtimes(archive, t, t)
+        }
+        return err
+}
+
+// findMember looks up the member in the opened archive, it returns the
+// offset of the member header.
+func findMember(f *os.File, archive, member string) (*memberInfo, int64, error) {
+        magic := make([]byte, len(archiveMagic))
+        if _, err := io.ReadFull(f, magic); err != nil || string(magic) != archiveMagic {
+                return nil, 0, fmt.Errorf("'%v' is not an archive", archive)
+        }
+
+        // Each member has a 60 bytes header: name[16] date[12] uid[6]
+        // gid[6] mode[8] size[10] magic[2], and data padded to even size.
+        var names []byte // GNU long names table
+        header, pos := make([]byte, 60), int64(len(archiveMagic))
+        for {
+                if _, err := io.ReadFull(f, header); err == io.EOF {
+                        break
+                } else if err != nil || string(header[58:60]) != "`\n" {
+                        return nil, 0, fmt.Errorf("'%v' is broken", archive)
+                }
+                field := func(i, n int) string { return strings.TrimSpace(string(header[i:i+n])) }
+                name := field(0, 16)
+                size, _ := strconv.ParseInt(field(48, 10), 10, 64)
+                data := size + size%2
+                switch {
+                case name == "//":
+                        names = make([]byte, size)
+                        if _, err := io.ReadFull(f, names); err != nil {
+                                return nil, 0, err
+                        }
+                        data -= size
+                case strings.HasPrefix(name, "#1/"): // BSD long name
+                        n, _ := strconv.ParseInt(name[3:], 10, 64)
+                        b := make([]byte, n)
+                        if _, err := io.ReadFull(f, b); err != nil {
+                                return nil, 0, err
+                        }
+                        name, size, data = string(bytes.TrimRight(b, "\x00")), size - n, data - n
+                case strings.HasPrefix(name, "/") && 1 < len(name) && names != nil:
+                        if off, e := strconv.Atoi(name[1:]); e == nil && off < len(names) {
+                                name = string(names[off:])
+                                if i := strings.Index(name, "/\n"); 0 <= i {
+                                        name = name[:i]
+                                }
+                        }
+                default:
+                        name = strings.TrimSuffix(name, "/")
+                }
+                if name == member {
+                        date, _ := strconv.ParseInt(field(16, 12), 10, 64)
+                        mode, _ := strconv.ParseUint(field(40, 8), 8, 32)
+                        return &memberInfo{ name, size, os.FileMode(mode).Perm(), time.Unix(date, 0) }, pos, nil
+                }
+                var err error
+                if pos, err = f.Seek(data, io.SeekCurrent); err != nil {
+                        return nil, 0, err
+                }
+        }
+        return nil, 0, &os.PathError{ Op:"stat", Path:archive + "(" + member + ")", Err:os.ErrNotExist }
+}
@@ -0,0 +1,70 @@
+//
+//  Copyright (C) 2012-2016, Duzy Chan <code@duzy.info>, all rights reserverd.
+//
+package smart
+
+import (
+        "os"
+        "fmt"
+        "bytes"
+        "strings"
+        "testing"
+        "io/ioutil"
+        "path/filepath"
+)
+
+func TestExpandArchiveMembers(t *testing.T) {
+        for _, c := range []struct{ s, x string }{
+                { "lib.a(foo.o)", "lib.a(foo.o)" },
+                { "a lib.a(foo.o bar.o) b", "a lib.a(foo.o) lib.a(bar.o) b" },
+                { "lib.a( foo.o )", "lib.a(foo.o)" },
+                { "lib.a(foo.o", "lib.a(foo.o)" },
+                { "foo.o", "foo.o" },
+        } {
+                if s := strings.Join(expandArchiveMembers(strings.Fields(c.s)), " "); s != c.x { t.Errorf("'%v' != '%v'", s, c.x) }
+        }
+        if a, m, ok := splitArchiveMember("out/lib.a(foo.o)"); !ok || a != "out/lib.a" || m != "foo.o" { t.Errorf("%v %v %v", a, m, ok) }
+        if _, _, ok := splitArchiveMember("lib.a()"); ok { t.Errorf("empty member") }
+}
+
+func TestStatMember(t *testing.T) {
+        dir, err := ioutil.TempDir("", "smart-archive")
+        if err != nil { t.Fatalf("%v", err) }
+        defer os.RemoveAll(dir)
+
+        header := func(b *bytes.Buffer, name string, date int64, size int) {
+                fmt.Fprintf(b, "%-16s%-12d%-6d%-6d%-8o%-10d`\n", name, date, 0, 0, 0644, size)
+        }
+        member := func(b *bytes.Buffer, name string, date int64, data string) {
+                header(b, name, date, len(data))
+                b.WriteString(data)
+                if len(data) % 2 == 1 { b.WriteString("\n") }
+        }
+
+        // GNU archive with a symbol table and long names.
+        gnu := bytes.NewBufferString(archiveMagic)
+        member(gnu, "/", 0, "symbols")
+        member(gnu, "//", 0, "a_very_long_member_name.o/\n")
+        member(gnu, "foo.o/", 1000, "foo")
+        member(gnu, "/0", 2000, "long")
+
+        // BSD archive with long names after headers.
+        bsd := bytes.NewBufferString(archiveMagic)
+        member(bsd, "#1/25", 3000, "a_very_long_member_name.olong")
+        member(bsd, "foo.o", 4000, "fo")
+
+        for _, c := range []struct{ archive *bytes.Buffer; name string; date, size int64 }{
+                { gnu, "foo.o", 1000, 3 },
+                { gnu, "a_very_long_member_name.o", 2000, 4 },
+                { bsd, "a_very_long_member_name.o", 3000, 4 },
+                { bsd, "foo.o", 4000, 2 },
+        } {
+                name := filepath.Join(dir, "lib.a")
+                ioutil.WriteFile(name, c.archive.Bytes(), 0644)
+                if fi, err := statFile(name + "(" + c.name + ")"); err != nil { t.Errorf("%v: %v", c.name, err) } else {
+                        if fi.ModTime().Unix() != c.date || fi.Size() != c.size || fi.Name() != c.name { t.Errorf("%v: %v %v %v", c.name, fi.Name(), fi.ModTime().Unix(), fi.Size()) }
+                }
+                if _, err := statFile(name + "(bar.o)"); !os.IsNotExist(err) { t.Errorf("bar.o: %v", err) }
+        }
+        if _, err := statFile(filepath.Join(dir, "none.a(foo.o)")); !os.IsNotExist(err) { t.Errorf("%v", err) }
+}
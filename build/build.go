@@ -5,18 +5,24 @@ package smart
 
 import (
         "bytes"
+        "crypto/sha1"
+        "encoding/hex"
         "errors"
         "fmt"
         "io"
         //"io/ioutil"
         "os"
         "os/exec"
+        "os/signal"
         "path/filepath"
         "regexp"
         "runtime"
         "strings"
         "sort"
-        "github.com/duzy/worker"
+        "sync"
+        "sync/atomic"
+        "syscall"
+        "time"
 )
 
 var (
@@ -210,30 +216,24 @@ func (c *Excmd) run(targetHint string, args ...string) bool {
                                 //fmt.Printf("%v\n", strings.Join(cmd.Args, " "))
                         }
                 }
-
-                err := cmd.Run()
+                // Delegated commands (e.g. ndk-build) are like recursive
+                // recipes, they share the job slots by the jobserver.
+                var err error
+                if jobs.serial() {
+                        err = cmd.Run()
+                } else {
+                        jobs.setup(cmd)
+                        token := jobs.acquire()
+                        err = cmd.Run()
+                        jobs.release(token)
+                }
                 if err == nil {
                         updated = true
                 }
 
                 if (*flagL /**flagV && *flagVV*/) || err != nil {
                         if err != nil { message("%v (%v)", err, c.path) }
-                        if c.path != "" {
-                                fmt.Fprintf(os.Stderr, "--------------------------------------------------------------------------------\n")
-                                fmt.Fprintf(os.Stderr, "%v %v\n", c.path, strings.Join(args, " "))
-                        }
-                        so, se := c.stdout.String(), c.stderr.String()
-                        if so != "" {
-                                fmt.Fprintf(os.Stderr, "------------------------------------------------------------------------- stdout\n")
-                                fmt.Fprintf(os.Stderr, "%v", so)
-                                if !strings.HasSuffix(so, "\n") { fmt.Fprintf(os.Stderr, "\n") }
-                        }
-                        if se != "" {
-                                fmt.Fprintf(os.Stderr, "------------------------------------------------------------------------- stderr\n")
-                                fmt.Fprintf(os.Stderr, "%v", se)
-                                if !strings.HasSuffix(se, "\n") { fmt.Fprintf(os.Stderr, "\n") }
-                        }
-                        fmt.Fprintf(os.Stderr, "--------------------------------------------------------------------------------\n")
+                        dumpOutput(os.Stderr, fmt.Sprintf("%v %v", c.path, strings.Join(args, " ")), c.stdout.String(), c.stderr.String())
                         if err != nil { errorf(`failed executing "%v"`, c.path) }
                 }
 
@@ -336,35 +336,77 @@ func (m *Module) GetSources(ctx *Context) (sources []string) {
         return
 }
 
+// enter changes to the working directory of the module and makes it the
+// current module, the returned function restores them.
+func (m *Module) enter(ctx *Context) (restore func()) {
+        owd, err := os.Getwd()
+        if err != nil { errorf("get working directory: %v", err) }
+
+        wd := m.Get(ctx, "workdir")
+        if wd != owd {
+                if err = os.Chdir(wd); err != nil {
+                        errorf("change working directory: %v", err)
+                }
+        }
+
+        om := ctx.m
+        ctx.m = m // change current working module
+        return func() {
+                if wd != owd {
+                        if err = os.Chdir(owd); err != nil {
+                                errorf("change working directory: %v", err)
+                        }
+                }
+                ctx.m = om
+        }
+}
+
 func (m *Module) update(ctx *Context) (updated bool) {
         //fmt.Printf("Module.update: %s\n", m.goal)
         if !m.Updating {
                 if g, ok := m.files[m.goal]; ok && g != nil {
-                        owd, err := os.Getwd()
-                        if err != nil { errorf("get working directory: %v", err) }
-                        
-                        wd := m.Get(ctx, "workdir")
-                        if wd != owd {
-                                if err = os.Chdir(wd); err != nil {
-                                        errorf("change working directory: %v", err)
-                                }
-                        }
-                        
-                        om := ctx.m
-                        defer func(){ 
-                                if wd != owd {
-                                        if err = os.Chdir(owd); err != nil {
-                                                errorf("change working directory: %v", err)
-                                        }
-                                }
-                                ctx.m = om
-                        }()
-                        
-                        ctx.m = m // change current working module 
+                        defer m.enter(ctx)()
 
                         m.Updating = true
                         updated = g.updateAll(ctx)
                         m.Updating = false
+                        ctx.flushModuleOutput(m)
+                }
+        }
+        return
+}
+
+// path returns the path of the module's target relative to the current
+// working directory if possible.
+func (m *Module) path(ctx *Context, target string) string {
+        if filepath.IsAbs(target) {
+                return target
+        }
+        s := filepath.Join(m.Get(ctx, "workdir"), target)
+        if wd, err := os.Getwd(); err == nil {
+                if rel, err := filepath.Rel(wd, s); err == nil {
+                        s = rel
+                }
+        }
+        return s
+}
+
+// splitQualifiedName splits the qualified target name like `foo:bar.txt`
+// into the module name and the target.
+func splitQualifiedName(name string) (module, target string, ok bool) {
+        if i := strings.Index(name, ":"); 0 < i && i < len(name)-1 && !strings.ContainsAny(name[:i], `/\(`) {
+                module, target, ok = name[:i], name[i+1:], true
+        }
+        return
+}
+
+// findQualifiedRule finds the rule for the qualified target name like
+// `foo:bar.txt` in the files and patterns of module 'foo'. Names of
+// missing modules (e.g. `C:\foo`) are not qualified.
+func (ctx *Context) findQualifiedRule(name string) (mod *Module, m *match, r *rule) {
+        if s, target, ok := splitQualifiedName(name); ok {
+                if mod = ctx.modules[s]; mod != nil {
+                        m, r = mod.findMatchedRule(ctx, target)
                 }
         }
         return
@@ -372,11 +414,15 @@ func (m *Module) update(ctx *Context) (updated bool) {
 
 func (ctx *Context) update(target string) (updated bool) {
         //fmt.Printf("Context.update: %s\n", target)
+        if mod, m, r := ctx.findQualifiedRule(target); r != nil {
+                defer mod.enter(ctx)()
+                return r.update(ctx, m)
+        }
         if g, ok := ctx.g.files[target]; ok && g != nil {
                 updated = g.updateAll(ctx)
         }
         if m, ok := ctx.modules[target]; ok && m != nil {
-                updated = m.update(ctx) || updated
+                updated = ctx.updateModule(m) || updated
         }
         return
 }
@@ -582,21 +628,30 @@ func (c *phonyTargetUpdater) update(ctx *Context, r *rule, m *match) bool {
         //fmt.Printf("phonyTargetUpdater.update: %v\n", m.target)
 
         err, matchedPrerequisites, _ := r.updatePrerequisites(ctx, m)
-        if err != nil {
+        if err == errPrerequisitesFailed {
+                return false
+        } else if err != nil {
                 fmt.Fprintf(os.Stderr, "%v\n", err)
                 //os.Exit(-1)
                 return false
         }
 
-        needsExecute := true
+        needsExecute, reason := true, "phony target"
         checkRules := r.ns.getRules(nodeRuleChecker, m.target)
         if 0 < len(checkRules) {
                 for _, cr := range checkRules {
+                        s, lineno, colno := cr.getLocation()
                         if needsExecute = cr.c.check(ctx, cr, m); needsExecute {
+                                reason = fmt.Sprintf("checker rule at %v:%v:%v failed", s, lineno, colno)
                                 break
                         }
                 }
         }
+        if needsExecute {
+                r.explain(ctx, m, reason, "")
+        } else {
+                r.explain(ctx, m, "", "checker rules passed")
+        }
 
         if needsExecute {
                 //fmt.Printf("phonyTargetUpdater.update: %v\n", m.target)
@@ -606,10 +661,32 @@ func (c *phonyTargetUpdater) update(ctx *Context, r *rule, m *match) bool {
         return false
 }
 
+// explain prints the rule matched the target and the decision (-explain),
+// which is either the reason of updating or why it's not updated. Targets
+// to be updated are also printed with -d.
+func (r *rule) explain(ctx *Context, m *match, reason, uptodate string) {
+        if !*flagExplain {
+                if reason != "" {
+                        debug("updating '%v': %v", r.qualify(ctx, m.target), reason)
+                }
+                return
+        }
+        s, lineno, colno := r.getLocation()
+        target := fmt.Sprintf("'%v'", r.qualify(ctx, m.target))
+        if m.stem != "" {
+                target += fmt.Sprintf(" (stem '%v')", m.stem)
+        }
+        if reason != "" {
+                fmt.Fprintf(os.Stderr, "%v:%v:%v: %v: update: %v\n", s, lineno, colno, target, reason)
+        } else {
+                fmt.Fprintf(os.Stderr, "%v:%v:%v: %v: %v\n", s, lineno, colno, target, uptodate)
+        }
+}
+
 type defaultTargetUpdater struct {
 }
 func (c *defaultTargetUpdater) check(ctx *Context, r *rule, m *match) bool {
-        if fi, err := os.Stat(m.target); err != nil || fi == nil {
+        if fi, err := statFile(m.target); err != nil || fi == nil {
                 return true
         }
         return false
@@ -618,16 +695,58 @@ func (c *defaultTargetUpdater) update(ctx *Context, r *rule, m *match) bool {
         //fmt.Printf("defaultTargetUpdater.update: %v\n", m.target)
         
         err, matchedPrerequisites, updatedPrerequisites := r.updatePrerequisites(ctx, m)
-        if err != nil {
+        if err == errPrerequisitesFailed {
+                return false
+        } else if err != nil {
                 fmt.Fprintf(os.Stderr, "%v\n", err)
                 //os.Exit(-1)
                 return false
         }
 
-        fi, err := os.Stat(m.target)
+        fi, err := r.statTargets(m)
+        if err != nil && !r.grouped && !isDirTarget(m.target) {
+                // The target found in VPATH is checked instead, but it's
+                // made here if it has to be updated.
+                if path, ok := r.searchFile(ctx, m.target); ok {
+                        fi, err = statFile(path)
+                }
+        }
+        if isDirTarget(m.target) {
+                // A directory target is updated only if it's missing, since
+                // it's modification time changes whenever entries are added.
+                if err == nil && fi.IsDir() {
+                        r.explain(ctx, m, "", "directory exists")
+                        return false
+                }
+                r.explain(ctx, m, "directory is missing", "")
+                return r.execute(ctx, r.makeExecuteContext(ctx, nil, m, matchedPrerequisites)) == nil
+        }
+
         ec := r.makeExecuteContext(ctx, fi, m, matchedPrerequisites)
+
+        // Dependencies from the depfile are extra prerequisites.
+        var depends []string
+        if ctx.db != nil {
+                depends = ctx.db.depends(m.target)
+        }
+
+        // With content hashes, prerequisites are checked by contents instead
+        // of modification time, so touching files doesn't update targets.
+        hashed := false
+        if err == nil && ctx.db != nil && *flagHash {
+                var changed []string
+                inputs := append(append([]string{}, ec.prerequisites...), depends...)
+                if changed, hashed = ctx.db.checkHashes(m.target, inputs); hashed {
+                        ec.newer = changed
+                }
+        }
+
+        var rebuilt []string
 updated_loop:
         for _, mr := range updatedPrerequisites {
+                if isDirTarget(mr.target) { continue }
+                if _, e := statFile(mr.target); hashed && e == nil { continue }
+                rebuilt = append(rebuilt, mr.target)
                 for _, s := range ec.newer {
                         if s == mr.target { continue updated_loop }
                 }
@@ -635,9 +754,60 @@ updated_loop:
         }
 
         // Check if we need to update the target
-        if err != nil || 0 < len(updatedPrerequisites) || 0 < len(ec.newer) {
+        var reason string
+        switch {
+        case err != nil:
+                reason = "target is missing"
+        case 0 < len(rebuilt):
+                reason = fmt.Sprintf("prerequisite '%v' is rebuilt", rebuilt[0])
+        case 0 < len(ec.newer) && hashed:
+                reason = fmt.Sprintf("prerequisite '%v' is changed", ec.newer[0])
+        case 0 < len(ec.newer):
+                reason = fmt.Sprintf("prerequisite '%v' is newer", ec.newer[0])
+        case !hashed:
+                reason = checkDepends(depends, fi)
+        }
+
+        // The database tells if the command, prerequisites or variables are
+        // changed since the last update, only compared with -db. The
+        // signature is also a part of the cache key.
+        var command, vars string
+        if ctx.db != nil && (*flagDatabase || ctx.cache != nil) {
+                command, vars = r.signature(ctx, ec)
+                if reason == "" && *flagDatabase {
+                        reason = ctx.db.checkCommand(r.groupTargets(m), ec.prerequisites, command, vars)
+                }
+        }
+
+        r.explain(ctx, m, reason, "up to date")
+        if reason != "" {
                 //fmt.Printf("defaultTargetUpdater.update: execute: %v\n", m.target)
-                return r.execute(ctx, ec) == nil
+                var key string
+                if ctx.cache != nil && !(*flagN || *flagQ || *flagTouch) && r.isCacheable(m) {
+                        key = r.cacheKey(ctx, command, vars, ec.prerequisites)
+                        err = r.restoreCache(ctx, key, m)
+                } else {
+                        err = errNotCached
+                }
+                if err == errNotCached {
+                        if err = r.execute(ctx, ec); err == nil && key != "" {
+                                r.storeCache(ctx, key, m)
+                        }
+                }
+                // Targets touched (-t) are considered updated by the commands.
+                if err == nil && ctx.db != nil && !*flagN && !*flagQ {
+                        if *flagDatabase {
+                                ctx.db.recordCommand(r.groupTargets(m), ec.prerequisites, command, vars)
+                        }
+                        if *flagHash {
+                                depends = ctx.db.depends(m.target)
+                                ctx.db.recordHashes(r.groupTargets(m), append(ec.prerequisites, depends...))
+                        }
+                }
+                return err == nil
+        }
+        if !hashed && ctx.db != nil && *flagHash {
+                ctx.db.recordHashes(r.groupTargets(m), append(ec.prerequisites, depends...))
         }
 
         return false
@@ -659,6 +829,7 @@ func (m *match) unstem(s string) (ss string, ok bool) {
 type matchrules struct {
         *match
         rules []*rule 
+        module *Module // the module of a qualified prerequisite like `foo:bar.txt`
 }
 
 func (r *rule) match(target string) (m *match, matched bool) {
@@ -672,13 +843,11 @@ func (r *rule) match(target string) (m *match, matched bool) {
                         }
                 }
         case rulePercentPattern:
+                // The pattern giving the shortest stem is matched.
                 for _, pat := range r.targets {
-                        if pos := strings.Index(pat, "%"); 0 <= pos {
-                                prefix, suffix := pat[0:pos], pat[pos+1:]
-                                if strings.HasPrefix(target, prefix) && strings.HasSuffix(target, suffix) {
-                                        matched, m = true, &match{ target:target }
-                                        m.stem = strings.TrimSuffix(strings.TrimPrefix(target, prefix), suffix)
-                                        return
+                        if strings.Contains(pat, "%") {
+                                if stem, ok := matchPercent(pat, target); ok && (m == nil || len(stem) < len(m.stem)) {
+                                        matched, m = true, &match{ target:target, stem:stem }
                                 }
                         } else {
                                 errorf(fmt.Sprintf("invalid pattern '%v'", pat))
@@ -705,32 +874,168 @@ func (r *rule) check(ctx *Context, m *match) (needsUpdate bool) {
         return needsUpdate
 }
 
-func (r *rule) update(ctx *Context, m *match) (updated bool) {
-        updated = r.c.update(ctx, r, m)
+// groupTargets returns all targets produced together with the matched one.
+func (r *rule) groupTargets(m *match) (targets []string) {
+        if !r.grouped {
+                return []string{ m.target }
+        }
+        for _, t := range r.targets {
+                t, _ = m.unstem(t)
+                targets = append(targets, t)
+        }
+        return
+}
 
-        // TODO: update in the namespace instead, supporting multipart names (a.b.c)
-        if m, ok := ctx.modules[m.target]; ok && m != nil {
-                updated = m.update(ctx) || updated
+// statTargets stats the targets of the match, it returns the oldest one of
+// a grouped rule, or an error if any of them is missing.
+func (r *rule) statTargets(m *match) (fi os.FileInfo, err error) {
+        for _, t := range r.groupTargets(m) {
+                var ti os.FileInfo
+                if ti, err = statFile(t); err != nil {
+                        return nil, err
+                }
+                if fi == nil || ti.ModTime().Before(fi.ModTime()) {
+                        fi = ti
+                }
         }
         return
 }
 
+// enterScope makes the module and the file defining the rule current, so
+// that `me` in recipes and prerequisites always refers to the module which
+// wrote them. It returns a function to restore the previous scope.
+func (r *rule) enterScope(ctx *Context) (restore func()) {
+        saveModule, saveLex := ctx.m, ctx.l
+        ctx.m = r.module
+        if r.node != nil && r.node.l != nil {
+                ctx.l = r.node.l
+        }
+        return func() { ctx.m, ctx.l = saveModule, saveLex }
+}
+
+// qualify returns the target name qualified by the module defining the
+// rule, e.g. `foo:bar.txt`, global targets are not qualified.
+func (r *rule) qualify(ctx *Context, target string) string {
+        if r.module != nil {
+                return r.module.GetName(ctx) + ":" + target
+        }
+        return target
+}
+
+// getLocation returns where the rule is defined.
+func (r *rule) getLocation() (s string, lineno, colno int) {
+        if n := r.node; n != nil && n.l != nil {
+                lineno, colno = n.l.caculateLocationLineColumn(n.children[0].loc())
+                s = n.l.scope
+        }
+        return
+}
+
+// getShell returns the shell and it's flags used to execute recipes, the
+// module variables `me.shell` and `me.shellflags` overrides the global
+// `SHELL` and `.SHELLFLAGS`, target-specific ones (e.g. `foo: SHELL := bash`)
+// override both. Job variables must be bound before calling it.
+func (r *rule) getShell(ctx *Context) (sh string, flags []string) {
+        sh, flags = "sh", []string{ "-c" }
+        lookup := func(shell, shellflags Items) {
+                if s := strings.TrimSpace(shell.Expand(ctx)); s != "" { sh = s }
+                if s := Split(shellflags.Expand(ctx)); 0 < len(s) { flags = s }
+        }
+        value := func(defines map[string]*define, name string) Items {
+                if d, ok := defines[name]; ok && d != nil {
+                        return d.value
+                }
+                return nil
+        }
+        lookup(value(ctx.g.defines, "SHELL"), value(ctx.g.defines, ".SHELLFLAGS"))
+        if m := r.module; m != nil {
+                lookup(value(m.defines, "shell"), value(m.defines, "shellflags"))
+        }
+        lookup(ctx.auto["SHELL"], ctx.auto[".SHELLFLAGS"])
+        return
+}
+
+// jobVars returns the variables bound to the job updating the target, the
+// automatic variables and the target-specific variables.
+func (r *rule) jobVars(ctx *Context, ec *ruleExecuteContext) map[string]Items {
+        vars := ec.autoVars()
+        ctx.g.getTargetDefines(ec.target, vars)
+        if m := r.module; m != nil {
+                m.getTargetDefines(ec.target, vars)
+        }
+        return vars
+}
+
+// isSpecial tells if the special target (e.g. `.ONESHELL`) applies to the
+// target globally or in the rule's namespace, or the module variable (e.g.
+// `me.oneshell`) is set.
+func (r *rule) isSpecial(ctx *Context, special, variable, target string) bool {
+        if ctx.g.isSpecialTarget(special, target) || r.ns.isSpecialTarget(special, target) {
+                return true
+        }
+        if m := r.module; m != nil && variable != "" {
+                return strings.TrimSpace(m.Get(ctx, variable)) != ""
+        }
+        return false
+}
+
+// start starts the task updating the matched target, all targets of a
+// grouped rule are updated by one task.
+func (r *rule) start(ctx *Context, m *match) *task {
+        key := ruleKey{ r, r.groupTargets(m)[0] }
+        if t, ok := ctx.tasks[key]; ok && ctx.task.within(t) {
+                return ctx.cycle(r, key.target, t)
+        }
+        return ctx.spawn(key, func() (updated bool) {
+                updated = r.c.update(ctx, r, m)
+
+                // A target named after a module also updates the module,
+                // module targets are named like `foo:bar.txt` instead.
+                if mod, ok := ctx.modules[m.target]; ok && mod != nil {
+                        updated = ctx.updateModule(mod) || updated
+                }
+                return
+        })
+}
+
+func (r *rule) update(ctx *Context, m *match) bool {
+        t := r.start(ctx, m)
+        ctx.wait(t)
+        return t.updated
+}
+
 func (r *rule) updateAll(ctx *Context) bool {
-        var num = 0
+        var ts []*task
         for _, t := range r.targets {
-                m := &match{ target:t }
-                if r.update(ctx, m) { num++ }
+                ts = append(ts, r.start(ctx, &match{ target:t }))
+        }
+        ctx.wait(ts...)
+
+        var num = 0
+        for _, t := range ts {
+                if t.updated { num++ }
         }
         return 0 < num
 }
 
 func (r *rule) updatePrerequisites(ctx *Context, m *match) (err error, matchedPrerequisites, updatedPrerequisites []*matchrules) {
-        for _, prerequisite := range r.prerequisites {
+        target, prerequisites := m.target, r.prerequisites
+        if r.expansion != nil {
+                prerequisites = r.expandPrerequisites(ctx, m)
+        }
+        for _, prerequisite := range prerequisites {
                 prerequisite, _ = m.unstem(prerequisite)
-                if m, rs := r.ns.findMatchedRules(ctx, prerequisite); m != nil && 0 < len(rs) {
-                        matchedPrerequisites = append(matchedPrerequisites, &matchrules{ m, rs })
+                if mod, m, rr := ctx.findQualifiedRule(prerequisite); m != nil && rr != nil {
+                        matchedPrerequisites = append(matchedPrerequisites, &matchrules{ m, []*rule{ rr }, mod })
+                } else if m, rr := r.ns.findMatchedRule(ctx, prerequisite); m != nil && rr != nil {
+                        matchedPrerequisites = append(matchedPrerequisites, &matchrules{ m, []*rule{ rr }, nil })
+                } else if path, ok := r.searchFile(ctx, prerequisite); ok {
+                        // A file without rules is a prerequisite as it is,
+                        // it's searched in VPATH if it's not here.
+                        matchedPrerequisites = append(matchedPrerequisites, &matchrules{ &match{ target:path }, nil, nil })
                 } else if r.kind == ruleFileTarget {
                         err = errors.New(fmt.Sprintf("no rule to update '%v'", prerequisite))
+                        ctx.fail(r, target, err)
                         return
                 } else {
                         fi, _ := os.Stat(prerequisite)
@@ -738,24 +1043,78 @@ func (r *rule) updatePrerequisites(ctx *Context, m *match) (err error, matchedPr
                 }
         }
         //fmt.Printf("updatePrerequisites: %v %v\n", r.prerequisites, matchedPrerequisites)
+
+        // Prerequisites are updated concurrently by the selected rules,
+        // qualified ones are updated in their modules.
+        var ts []*task
         for _, mr := range matchedPrerequisites {
-                for _, r := range mr.rules {
-                        if ok := r.update(ctx, mr.match); ok {
-                                updatedPrerequisites = append(updatedPrerequisites, mr)
-                                break
+                mr := mr
+                key := prerequisiteKey{ r.ns, mr.target }
+                if mr.module != nil {
+                        key.ns = mr.module
+                }
+                if t, ok := ctx.tasks[key]; ok && 0 < len(mr.rules) && ctx.task.within(t) {
+                        ts = append(ts, ctx.cycle(mr.rules[0], mr.target, t))
+                        continue
+                }
+                ts = append(ts, ctx.spawn(key, func() bool {
+                        if mr.module != nil {
+                                defer mr.module.enter(ctx)()
+                        }
+                        for _, r := range mr.rules {
+                                if ok := r.update(ctx, mr.match); ok {
+                                        return true
+                                }
+                        }
+                        return false
+                }))
+        }
+        ctx.wait(ts...)
+        for i, t := range ts {
+                // Targets not made here are searched in VPATH, like GNU
+                // make, the found paths are used in `$<` and `$^`.
+                if mr := matchedPrerequisites[i]; mr.module != nil {
+                        // Targets of other modules are made in their
+                        // working directories.
+                        if mr.rules[0].node.kind != nodeRulePhony {
+                                matchedPrerequisites[i] = &matchrules{ &match{ target:mr.module.path(ctx, mr.target), stem:mr.stem }, mr.rules, mr.module }
                         }
+                } else if 0 < len(mr.rules) && mr.rules[0].node.kind != nodeRulePhony {
+                        if path, ok := r.searchFile(ctx, mr.target); ok && path != mr.target {
+                                matchedPrerequisites[i] = &matchrules{ &match{ target:path, stem:mr.stem }, mr.rules, nil }
+                        }
+                }
+                if t.failed {
+                        err = errPrerequisitesFailed
+                } else if t.updated {
+                        updatedPrerequisites = append(updatedPrerequisites, matchedPrerequisites[i])
                 }
         }
         return
 }
 
+// expandPrerequisites expands the prerequisites again for the matched
+// target (.SECONDEXPANSION), with automatic variables like `$@` and `$*`
+// and the module `me` bound.
+func (r *rule) expandPrerequisites(ctx *Context, m *match) []string {
+        saveAuto := ctx.auto
+        defer func() { ctx.auto = saveAuto }()
+        defer r.enterScope(ctx)()
+        ctx.auto = (&ruleExecuteContext{ target:m.target, stem:m.stem }).autoVars()
+        return expandArchiveMembers(Split(ctx.nodeItems(r.expansion).Expand(ctx)))
+}
+
 func (r *rule) makeExecuteContext(ctx *Context, ti os.FileInfo, m *match, matchedPrerequisites []*matchrules) *ruleExecuteContext {
         ec := &ruleExecuteContext{ target: m.target, stem: m.stem }
         for _, mr := range matchedPrerequisites {
                 ec.prerequisites = append(ec.prerequisites, mr.target)
-                if ti != nil {
-                        if fi, err := os.Stat(mr.target); err == nil {
-                                if fi.ModTime().After(ti.ModTime()) {
+                if ti != nil && !isDirTarget(mr.target) {
+                        if fi, err := statFile(mr.target); err == nil {
+                                mt := fi.ModTime()
+                                if _, ok := ti.(*memberInfo); ok {
+                                        mt = mt.Truncate(time.Second) // archives record seconds
+                                }
+                                if mt.After(ti.ModTime()) {
                                         ec.newer = append(ec.newer, mr.target)
                                 }
                         }
@@ -765,6 +1124,26 @@ func (r *rule) makeExecuteContext(ctx *Context, ti os.FileInfo, m *match, matche
         return ec
 }
 
+// isDirTarget tells if the target names a directory (e.g. `out/`).
+func isDirTarget(target string) bool {
+        return 1 < len(target) && strings.HasSuffix(target, "/")
+}
+
+// makeTargetDirs creates the directories of the targets, or the targets
+// themselves if they're directory targets.
+func makeTargetDirs(targets []string) error {
+        for _, t := range targets {
+                d := t
+                if !isDirTarget(t) {
+                        d = filepath.Dir(t)
+                }
+                if err := os.MkdirAll(d, 0755); err != nil {
+                        return err
+                }
+        }
+        return nil
+}
+
 func targetDirBaseItems(targets []string) (items, itemsDir, itemsBase Items) {
         for _, target := range targets {
                 items = append(items, stringitem(target))
@@ -776,7 +1155,7 @@ func targetDirBaseItems(targets []string) (items, itemsDir, itemsBase Items) {
 
 type ruleExecuteContext struct {
         target, stem string
-        prerequisites, newer []string
+        prerequisites, newer []string // in order, with duplicates
 }
 
 // https://www.gnu.org/software/make/manual/html_node/Automatic-Variables.html#Automatic-Variables
@@ -794,10 +1173,9 @@ type ruleExecuteContext struct {
 //      
 //   $(@D) $(@F) $(*D) $(*F) $(%D) $(%F) $(<D) $(<F) $(^D) $(^F) $(+D) $(+F) $(?D) $(?F)
 //   
-func (r *rule) execute(ctx *Context, ec *ruleExecuteContext) error {
-        ns := ctx.g
-        
-        saveIndex, _ := ns.saveDefines(
+func (ec *ruleExecuteContext) autoVars() (auto map[string]Items) {
+        auto = make(map[string]Items, 24)
+        for _, s := range []string{
                 "@", "@D", "@F",
                 "%", "%D", "%F",
                 "<", "<D", "<F",
@@ -805,73 +1183,403 @@ func (r *rule) execute(ctx *Context, ec *ruleExecuteContext) error {
                 "^", "^D", "^F",
                 "+", "+D", "+F",
                 "|", "|D", "|F",
-                "*", "*D", "*F")
-        defer ns.restoreDefines(saveIndex)
-
-        ns.Set(ctx, []string{ "@" },  stringitem(ec.target))
-        ns.Set(ctx, []string{ "@D" }, stringitem(filepath.Dir(ec.target)))
-        ns.Set(ctx, []string{ "@F" }, stringitem(filepath.Base(ec.target)))
-        ns.Set(ctx, []string{ "*" },  stringitem(ec.stem))
-        ns.Set(ctx, []string{ "*D" }, stringitem(filepath.Dir(ec.stem)))
-        ns.Set(ctx, []string{ "*F" }, stringitem(filepath.Base(ec.stem)))
+                "*", "*D", "*F",
+        } {
+                auto[s] = nil
+        }
+
+        target := ec.target
+        if archive, member, ok := splitArchiveMember(target); ok {
+                target = archive
+                auto["%"] = Items{ stringitem(member) }
+                auto["%D"] = Items{ stringitem(filepath.Dir(member)) }
+                auto["%F"] = Items{ stringitem(filepath.Base(member)) }
+        }
+        auto["@"] = Items{ stringitem(target) }
+        auto["@D"] = Items{ stringitem(filepath.Dir(target)) }
+        auto["@F"] = Items{ stringitem(filepath.Base(target)) }
+        auto["*"] = Items{ stringitem(ec.stem) }
+        auto["*D"] = Items{ stringitem(filepath.Dir(ec.stem)) }
+        auto["*F"] = Items{ stringitem(filepath.Base(ec.stem)) }
         if 0 < len(ec.prerequisites) {
-                l, ld, lf := targetDirBaseItems(ec.prerequisites)
-                ns.Set(ctx, []string{ "<" },  l[0])
-                ns.Set(ctx, []string{ "<D" }, ld[0])
-                ns.Set(ctx, []string{ "<F" }, lf[0])
-                ns.Set(ctx, []string{ "^" }, l...)
-                ns.Set(ctx, []string{ "^D" }, ld...)
-                ns.Set(ctx, []string{ "^F" }, lf...)
+                l, ld, lf := targetDirBaseItems(ec.prerequisites[0:1])
+                auto["<"], auto["<D"], auto["<F"] = l, ld, lf
+                members := memberNames(ec.prerequisites)
+                auto["^"], auto["^D"], auto["^F"] = targetDirBaseItems(uniqueNames(members))
+                auto["+"], auto["+D"], auto["+F"] = targetDirBaseItems(members)
         }
         if 0 < len(ec.newer) {
-                l, ld, lf := targetDirBaseItems(ec.newer)
-                ns.Set(ctx, []string{ "?" }, l...)
-                ns.Set(ctx, []string{ "?D" }, ld...)
-                ns.Set(ctx, []string{ "?F" }, lf...)
+                auto["?"], auto["?D"], auto["?F"] = targetDirBaseItems(uniqueNames(memberNames(ec.newer)))
         }
-        
-        job := new(executeRecipes)
+        return
+}
+
+// uniqueNames returns the names with duplicates removed, the first one of
+// duplicated names is kept.
+func uniqueNames(names []string) (result []string) {
+        seen := make(map[string]bool, len(names))
+        for _, s := range names {
+                if !seen[s] {
+                        seen[s] = true
+                        result = append(result, s)
+                }
+        }
+        return
+}
+
+// expandRecipes expands the recipes in the current scope, automatic
+// variables must be bound before expanding.
+func (r *rule) expandRecipes(ctx *Context, ec *ruleExecuteContext) (recipes []*recipe) {
         for _, action := range r.recipes {
                 var s string
                 switch a := action.(type) {
                 case string: s = a
                 case *node: s = a.Expand(ctx)
                 }
-                job.recipes = append(job.recipes, s)
+                recipes = append(recipes, parseRecipe(s))
+        }
+        if r.isSpecial(ctx, ".ONESHELL", "oneshell", ec.target) {
+                recipes = joinRecipes(recipes)
+        }
+        return
+}
+
+// signature returns the command and the hash of variables used by the
+// recipes, they're recorded in the database to tell if the target is
+// changed. Recipes are expanded quietly without `$?` (which is different
+// in every update).
+func (r *rule) signature(ctx *Context, ec *ruleExecuteContext) (command, vars string) {
+        e := *ec
+        e.newer = nil
+
+        saveAuto, saveQuiet := ctx.auto, ctx.quiet
+        ctx.auto, ctx.used, ctx.quiet = r.jobVars(ctx, &e), make(map[string]Items), true
+        defer func() { ctx.auto, ctx.used, ctx.quiet = saveAuto, nil, saveQuiet }()
+        defer r.enterScope(ctx)()
+
+        var lines []string
+        for _, rc := range r.expandRecipes(ctx, &e) {
+                lines = append(lines, rc.s)
+        }
+
+        used, names := ctx.used, []string{}
+        ctx.used = nil
+        for name := range used {
+                names = append(names, name)
+        }
+        sort.Strings(names)
+
+        h := sha1.New()
+        for _, name := range names {
+                fmt.Fprintf(h, "%s=%s\n", name, used[name].Expand(ctx))
         }
-        /*
-        if *flagJ <= 1 {
-                job.Action()
+        return strings.Join(lines, "\n"), hex.EncodeToString(h.Sum(nil))
+}
+
+func (r *rule) execute(ctx *Context, ec *ruleExecuteContext) error {
+        if r.node.kind != nodeRuleChecker && ctx.stopped() {
+                return errStopped
+        }
+
+        // Automatic variables are bound to the job instead of the global
+        // namespace, since recipes of other jobs are expanded meanwhile.
+        saveAuto := ctx.auto
+        ctx.auto = r.jobVars(ctx, ec)
+        defer func() { ctx.auto = saveAuto }()
+        
+        job := &executeRecipes{ target:ec.target, out:newJobOutput(ctx, r, ec.target) }
+        defer r.enterScope(ctx)()
+        job.dir, _ = os.Getwd()
+        job.shell, job.shellflags = r.getShell(ctx)
+        job.recipes = r.expandRecipes(ctx, ec)
+        if r.node.kind != nodeRuleChecker {
+                // Only '+' recipes are executed in question mode, the target
+                // is reported to be updated.
+                if *flagQ {
+                        for _, rc := range job.recipes {
+                                if rc.s != "" { ctx.stale = true }
+                        }
+                }
+                job.dryRun = *flagN || *flagQ || *flagTouch
+        }
+        var targets []string
+        var depfile string
+        if k := r.node.kind; k != nodeRulePhony && k != nodeRuleChecker {
+                targets = r.groupTargets(&match{ target:ec.target, stem:ec.stem })
+                depfile = r.getDepfile(ctx, ec.target)
+                if isDirTarget(ec.target) || r.isSpecial(ctx, ".MKDIR", "mkdir", ec.target) {
+                        if err := makeTargetDirs(targets); err != nil {
+                                s, lineno, colno := r.getLocation()
+                                fmt.Fprintf(os.Stderr, "%v:%v:%v: %v\n", s, lineno, colno, err)
+                                return err
+                        }
+                }
+                job.watchTargets(ctx, r, targets)
+        }
+        // Recipes are run without holding the context, a slot of the pool
+        // and a job slot from the jobserver are taken before running. With
+        // only one job slot or in hermetic mode, the context is kept so that
+        // targets are updated strictly in order. Recipes not checked (e.g.
+        // phony ones) are also kept in order in hermetic mode, or their
+        // writes would be seen by the checked ones.
+        pool, weight := r.getPool(ctx, ec.target)
+        hermetic := *flagHermetic && targets != nil && !job.dryRun
+        run := func() {
+                pool.acquire(weight)
+                token := jobs.acquire()
+                waitLoad()
+                atomic.AddInt32(&activeJobs, 1)
+                if r.node.kind != nodeRuleChecker && ctx.stopped() {
+                        job.error = errStopped
+                } else if hermetic {
+                        roots := job.hermeticRoots(targets)
+                        before := takeSnapshot(roots)
+                        job.runRecipes()
+                        if job.error == nil && 0 < r.checkHermetic(job, before, takeSnapshot(roots), targets, depfile) && *flagStrict {
+                                job.error = errHermetic
+                        }
+                } else {
+                        job.runRecipes()
+                }
+                atomic.AddInt32(&activeJobs, -1)
+                jobs.release(token)
+                pool.release(weight)
+        }
+        if jobs.serial() || *flagHermetic {
+                run()
         } else {
-                ctx.w.Do(job)
-        } */
-        job.Action()
+                ctx.unlockWhile(run)
+        }
+        job.out.flush()
+        if job.error == errStopped {
+                return job.error
+        }
+        if job.error != nil && r.node.kind != nodeRuleChecker {
+                s, lineno, colno := r.getLocation()
+                fmt.Fprintf(os.Stderr, "%v:%v:%v: recipe for '%v' failed: %v\n", s, lineno, colno, r.qualify(ctx, ec.target), job.error)
+                if *flagDeleteOnError || r.isSpecial(ctx, ".DELETE_ON_ERROR", "", ec.target) {
+                        job.deleteTargets()
+                }
+                ctx.fail(r, ec.target, job.error)
+        }
+        if job.error == nil && *flagTouch && targets != nil {
+                job.touchTargets(targets)
+        }
+        if job.error == nil && depfile != "" && ctx.db != nil && !job.dryRun {
+                if depends, err := readDepfile(depfile); err == nil {
+                        ctx.db.recordDepends(targets, depends)
+                } else if !os.IsNotExist(err) {
+                        s, lineno, colno := r.getLocation()
+                        fmt.Fprintf(os.Stderr, "%v:%v:%v: depfile '%v': %v\n", s, lineno, colno, depfile, err)
+                }
+        }
         return job.error
 }
 
+// recipe is an expanded recipe line with the prefixes parsed.
+type recipe struct {
+        s string
+        echo bool // no '@' prefix
+        ignoreError bool // '-' prefix
+        force bool // '+' prefix, executed even if recipes are not executed
+}
+
+// parseRecipe parses prefixes like `@`, `-`, `+` and combinations like
+// `@-` of a recipe line.
+func parseRecipe(s string) (rc *recipe) {
+        rc = &recipe{ echo:true }
+prefix_loop:
+        for ; 0 < len(s); s = s[1:] {
+                switch s[0] {
+                case '@': rc.echo = false
+                case '-': rc.ignoreError = true
+                case '+': rc.force = true
+                case ' ', '\t': // spaces between prefixes
+                default: break prefix_loop
+                }
+        }
+        rc.s = s
+        return
+}
+
+// joinRecipes joins recipe lines into one script for `.ONESHELL`, prefixes
+// of the first line apply to the whole script, the others are stripped.
+func joinRecipes(recipes []*recipe) []*recipe {
+        if len(recipes) < 2 {
+                return recipes
+        }
+        rc, lines := *recipes[0], []string{}
+        for _, r := range recipes {
+                lines = append(lines, r.s)
+        }
+        rc.s = strings.Join(lines, "\n")
+        return []*recipe{ &rc }
+}
+
 type executeRecipes struct {
-        recipes []string
+        target string
+        dir string // the working directory
+        out *jobOutput
+        shell string
+        shellflags []string
+        recipes []*recipe
         error error
+        cmd *exec.Cmd // the running command
+        dryRun bool // only '+' recipes are executed (-n or -t)
+        targets map[string]time.Time // targets to delete if interrupted
 }
-func (job *executeRecipes) Action() worker.Result {
-        for _, s := range job.recipes {
-                echo := true
-                if s[0] == '@' {
-                        s, echo = s[1:], false
+
+// watchTargets records the targets and their modification time before
+// running recipes, so they could be deleted on failures or interrupts. The
+// targets marked by `.PRECIOUS` or `me.precious` are never deleted.
+func (job *executeRecipes) watchTargets(ctx *Context, r *rule, targets []string) {
+        for _, t := range targets {
+                if r.isSpecial(ctx, ".PRECIOUS", "precious", t) {
+                        continue
                 }
-                if cmd := exec.Command("sh", "-c", s); cmd != nil {
-                        cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
-                        if echo { fmt.Printf("%v\n", s) }
-                        if job.error = cmd.Run(); job.error != nil {
-                                break
+                if job.targets == nil {
+                        job.targets = make(map[string]time.Time, len(targets))
+                }
+                if fi, err := os.Stat(t); err == nil && !fi.IsDir() {
+                        job.targets[t] = fi.ModTime()
+                } else {
+                        job.targets[t] = time.Time{}
+                }
+        }
+}
+
+// touchTargets touches the targets instead of updating them (-t), they are
+// only printed with -n.
+func (job *executeRecipes) touchTargets(targets []string) {
+        now := time.Now()
+        for _, t := range targets {
+                if isDirTarget(t) { continue }
+                fmt.Fprintf(job.out.stdout, "touch %v\n", t)
+                if *flagN { continue }
+                name := t
+                if !filepath.IsAbs(name) && job.dir != "" {
+                        name = filepath.Join(job.dir, name)
+                }
+                if archive, member, ok := splitArchiveMember(name); ok {
+                        if err := touchMember(archive, member, now); err != nil {
+                                fmt.Fprintf(os.Stderr, "smart: %v\n", err)
+                        }
+                        continue
+                }
+                if err := os.Chtimes(name, now, now); os.IsNotExist(err) {
+                        var f *os.File
+                        if f, err = os.Create(name); err == nil {
+                                f.Close()
+                        }
+                }
+        }
+}
+
+// deleteTargets deletes the targets modified by the recipes.
+func (job *executeRecipes) deleteTargets() {
+        for t, mt := range job.targets {
+                name := t
+                if !filepath.IsAbs(name) && job.dir != "" {
+                        name = filepath.Join(job.dir, name)
+                }
+                if fi, err := os.Stat(name); err == nil && !fi.IsDir() && !fi.ModTime().Equal(mt) {
+                        fmt.Fprintf(os.Stderr, "smart: deleting '%v'\n", t)
+                        os.Remove(name)
+                }
+        }
+}
+
+// runningJobs tracks the jobs running recipes for handling interrupts.
+var runningJobs = struct {
+        sync.Mutex
+        m map[*executeRecipes]bool
+}{ m:make(map[*executeRecipes]bool) }
+
+// exitInterrupted is added by the signal number as the exit status when
+// interrupted by a signal, as shells do.
+const exitInterrupted = 128
+
+// handleInterrupts kills running recipes and deletes their targets when
+// SIGINT or SIGTERM is received, then exits. It returns a function to stop
+// handling the signals.
+func handleInterrupts() (stop func()) {
+        c, done := make(chan os.Signal, 1), make(chan bool)
+        signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+        go func() {
+                select {
+                case sig := <-c:
+                        killJobs()
+                        fmt.Fprintf(os.Stderr, "smart: interrupted (%v)\n", sig)
+                        status := exitInterrupted
+                        if n, ok := sig.(syscall.Signal); ok {
+                                status += int(n)
+                        }
+                        os.Exit(status)
+                case <-done:
+                }
+        }()
+        return func() {
+                signal.Stop(c)
+                close(done)
+        }
+}
+
+// killJobs kills running recipes and deletes their targets. Recipes run in
+// their own process groups, the whole group is killed so that commands
+// started by the shell don't keep writing the targets.
+func killJobs() {
+        runningJobs.Lock()
+        defer runningJobs.Unlock()
+        for job := range runningJobs.m {
+                if job.cmd != nil && job.cmd.Process != nil {
+                        syscall.Kill(-job.cmd.Process.Pid, syscall.SIGKILL)
+                }
+                job.deleteTargets()
+        }
+}
+
+// run runs the command as a tracked job in a new process group.
+func (job *executeRecipes) run(cmd *exec.Cmd) (err error) {
+        cmd.SysProcAttr = &syscall.SysProcAttr{ Setpgid:true }
+        runningJobs.Lock()
+        if err = cmd.Start(); err == nil {
+                job.cmd, runningJobs.m[job] = cmd, true
+        }
+        runningJobs.Unlock()
+        if err == nil {
+                err = cmd.Wait()
+                runningJobs.Lock()
+                job.cmd = nil
+                delete(runningJobs.m, job)
+                runningJobs.Unlock()
+        }
+        return
+}
+
+// runRecipes runs the recipes in order, it stops at the first failure.
+func (job *executeRecipes) runRecipes() {
+        for _, rc := range job.recipes {
+                if rc.s == "" { continue }
+                if job.dryRun && !rc.force {
+                        if *flagN { fmt.Fprintf(job.out.stdout, "%v\n", rc.s) }
+                        continue
+                }
+                if cmd := exec.Command(job.shell, append(job.shellflags, rc.s)...); cmd != nil {
+                        cmd.Dir, cmd.Stdout, cmd.Stderr = job.dir, job.out.stdout, job.out.stderr
+                        if rc.force { jobs.setup(cmd) }
+                        if rc.echo { fmt.Fprintf(job.out.stdout, "%v\n", rc.s) }
+                        if err := job.run(cmd); err == nil {
+                                continue
+                        } else if rc.ignoreError {
+                                fmt.Fprintf(job.out.stderr, "smart: [%v] %v (ignored)\n", job.target, err)
                         } else {
-                                //fmt.Printf("rule: %v\n", s)
+                                job.error = err
+                                break
                         }
                 } else {
-                        errorf("nil command `sh`")
+                        errorf("nil command `%v`", job.shell)
                 }
         }
-        return nil
 }
 
 // Update updates the specified targets given in `cmds`.
@@ -891,21 +1599,29 @@ func (job *executeRecipes) Action() worker.Result {
 //      smart foobar
 // 
 func Update(ctx *Context, cmds ...string) {
-        ctx.w.SpawnN(*flagJ); defer ctx.w.KillAll()
+        stop := handleInterrupts(); defer stop()
+
+        ctx.beginUpdate()
+        defer ctx.endUpdate()
 
+        // Modules and command targets are updated concurrently.
+        var ts []*task
         if n := len(cmds); n == 0 {
                 if goal := ctx.g.goal; goal == "" {
                         for _, m := range ctx.moduleOrderList { 
-                                m.update(ctx)
+                                m := m
+                                ts = append(ts, ctx.spawn(m, func() bool { return m.update(ctx) }))
                         }
                 } else {
                         ctx.update(goal)
                 }
         } else {
                 for _, cmd := range cmds {
-                        ctx.update(cmd)
+                        cmd := cmd
+                        ts = append(ts, ctx.spawn(commandKey(cmd), func() bool { return ctx.update(cmd) }))
                 }
         }
+        ctx.wait(ts...)
 }
 
 // Build builds the project with specified variables and commands.
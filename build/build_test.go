@@ -7,11 +7,27 @@ import (
         "os"
         "fmt"
         "bytes"
+        "strings"
         "time"
         "testing"
         "io/ioutil"
+        "os/exec"
+        "path/filepath"
 )
 
+// captureStderr returns messages written to os.Stderr while running f.
+func captureStderr(f func()) (s string) {
+        r, w, err := os.Pipe()
+        if err != nil { panic(err) }
+        b, done := new(bytes.Buffer), make(chan bool)
+        go func() { b.ReadFrom(r); r.Close(); close(done) }()
+        saved := os.Stderr
+        os.Stderr = w
+        defer func() { os.Stderr = saved; w.Close(); <-done; s = b.String() }()
+        f()
+        return
+}
+
 func TestTraverse(t *testing.T) {
         m := map[string]bool{}
         err := traverse("../data", func(fn string, fi os.FileInfo) bool {
@@ -529,3 +545,699 @@ commit
 
         delete(hooksMap, "test")
 }
+
+func TestBuildGroupedTargets(t *testing.T) {
+        if wd, e := os.Getwd(); e != nil || workdir != wd { t.Errorf("%v != %v (%v)", workdir, wd, e) }
+
+        // Recipes are run one by one to keep the outputs in order.
+        defer SetFlagJ(GetFlagJ())
+        SetFlagJ(1)
+
+        info, f := new(bytes.Buffer), builtinInfoFunc; defer func(){ builtinInfoFunc = f }()
+        builtinInfoFunc = func(ctx *Context, args Items) {
+                fmt.Fprintf(info, "%v\n", args.Expand(ctx))
+        }
+
+        ctx, err := newTestContext("TestBuildGroupedTargets", `
+all:!: foo.h foo.c a.txt a.log
+foo.h foo.c &: foo.idl
+	@touch foo.h foo.c $(info 1: $@ $^)
+foo.idl:
+	@touch $@ $(info 2: $@)
+%.txt %.log:
+	@touch $*.txt $*.log $(info 3: $@ $*)
+`);     if err != nil { t.Errorf("parse error: %v", err) }
+        if r, ok := ctx.g.files["foo.h"]; !ok || r == nil { t.Errorf("'foo.h' not defined") } else {
+                if !r.grouped { t.Errorf("'foo.h' is not grouped") }
+                if k, x := r.node.children[0].kind, nodeGroupedTargets; k != x { t.Errorf("%v != %v", k, x) }
+                if n, x := len(r.targets), 2; n != x { t.Errorf("targets %d != %d (%v)", n, x, r.targets) }
+        }
+        if r, ok := ctx.g.patts["%.log"]; !ok || r == nil { t.Errorf("'%%.log' not defined") } else {
+                if !r.grouped { t.Errorf("'%%.log' is not grouped") }
+        }
+
+        os.Remove("foo.idl")
+        os.Remove("foo.h")
+        os.Remove("foo.c")
+        os.Remove("a.txt")
+        os.Remove("a.log")
+        Update(ctx)
+        if s, x := info.String(), `2: foo.idl
+1: foo.h foo.idl
+3: a.txt a
+`; s != x { t.Errorf("'%s' != '%s'", s, x) }
+        for _, s := range []string{ "foo.h", "foo.c", "a.txt", "a.log" } {
+                if fi, e := os.Stat(s); fi == nil || e != nil { t.Errorf("%v", e) }
+        }
+
+        info.Reset()
+        os.Remove("foo.c")
+        Update(ctx, "foo.c")
+        if s, x := info.String(), "1: foo.h foo.idl\n"; s != x { t.Errorf("'%s' != '%s'", s, x) }
+
+        os.Remove("foo.idl")
+        os.Remove("foo.h")
+        os.Remove("foo.c")
+        os.Remove("a.txt")
+        os.Remove("a.log")
+}
+
+func TestBuildRecipePrefixes(t *testing.T) {
+        if wd, e := os.Getwd(); e != nil || workdir != wd { t.Errorf("%v != %v (%v)", workdir, wd, e) }
+
+        for _, c := range []struct{ s, r string; echo, ignoreError, force bool }{
+                { "echo", "echo", true, false, false },
+                { "@echo", "echo", false, false, false },
+                { "-false", "false", true, true, false },
+                { "+echo", "echo", true, false, true },
+                { "@-false", "false", false, true, false },
+                { "-@ +echo", "echo", false, true, true },
+                { "", "", true, false, false },
+        } {
+                rc := parseRecipe(c.s)
+                if rc.s != c.r { t.Errorf("%v: '%v' != '%v'", c.s, rc.s, c.r) }
+                if rc.echo != c.echo { t.Errorf("%v: echo %v != %v", c.s, rc.echo, c.echo) }
+                if rc.ignoreError != c.ignoreError { t.Errorf("%v: ignoreError %v != %v", c.s, rc.ignoreError, c.ignoreError) }
+                if rc.force != c.force { t.Errorf("%v: force %v != %v", c.s, rc.force, c.force) }
+        }
+
+        ctx, err := newTestContext("TestBuildRecipePrefixes", `
+SHELL := bash
+.SHELLFLAGS := -euo pipefail -c
+
+foo.txt:
+	@-false
+	@echo $$0 > $@
+bar.txt:
+	@false | true
+	@echo $$0 > $@
+
+module foo
+me.shell := sh
+me.shellflags := -c
+foobar.txt:
+	@echo $$0 > $@
+commit
+`);     if err != nil { t.Errorf("parse error: %v", err) }
+        if s, x := ctx.Call(".SHELLFLAGS").Expand(ctx), "-euo pipefail -c"; s != x { t.Errorf("'%v' != '%v'", s, x) }
+
+        os.Remove("foo.txt")
+        os.Remove("bar.txt")
+        os.Remove("foobar.txt")
+        Update(ctx, "foo.txt", "foo", "bar.txt")
+        if b, e := ioutil.ReadFile("foo.txt"); e != nil { t.Errorf("%v", e) } else {
+                if s, x := string(b), "bash\n"; s != x { t.Errorf("'%v' != '%v'", s, x) }
+        }
+        if _, e := os.Stat("bar.txt"); e == nil { t.Errorf("bar.txt should not exist (pipefail)") }
+        if b, e := ioutil.ReadFile("foobar.txt"); e != nil { t.Errorf("%v", e) } else {
+                if s, x := string(b), "sh\n"; s != x { t.Errorf("'%v' != '%v'", s, x) }
+        }
+
+        os.Remove("foo.txt")
+        os.Remove("bar.txt")
+        os.Remove("foobar.txt")
+}
+
+func TestBuildTargetShell(t *testing.T) {
+        if wd, e := os.Getwd(); e != nil || workdir != wd { t.Errorf("%v != %v (%v)", workdir, wd, e) }
+        if _, err := exec.LookPath("bash"); err != nil { t.Skipf("bash: %v", err) }
+
+        ctx, err := newTestContext("TestBuildTargetShell", `
+NAME = global
+foo.txt: SHELL := bash
+foo.txt:
+	@echo $$0 > $@
+%.log: .SHELLFLAGS = -ec
+%.log: NAME = $@
+bar.log:
+	@false; echo $$0 $(NAME) > $@
+baz.log:
+	@echo $(NAME) > $@
+foobar.txt:
+	@echo $$0 $(NAME) > $@
+
+module foo
+me.shell := sh
+foo.out: SHELL := bash
+foo.out:
+	@echo $$0 > $@
+commit
+`);     if err != nil { t.Errorf("parse error: %v", err) }
+        if r := ctx.g.files["foo.txt"]; r == nil || 0 < len(r.prerequisites) { t.Errorf("foo.txt: %v", r) }
+
+        for _, s := range []string{ "foo.txt", "bar.log", "baz.log", "foobar.txt", "foo.out" } {
+                os.Remove(s)
+                defer os.Remove(s)
+        }
+        Update(ctx, "foo.txt", "baz.log", "foobar.txt", "foo")
+        if b, e := ioutil.ReadFile("foo.txt"); e != nil || string(b) != "bash\n" { t.Errorf("'%s' (%v)", b, e) }
+        if b, e := ioutil.ReadFile("baz.log"); e != nil || string(b) != "baz.log\n" { t.Errorf("'%s' (%v)", b, e) }
+        if b, e := ioutil.ReadFile("foobar.txt"); e != nil || string(b) != "sh global\n" { t.Errorf("'%s' (%v)", b, e) }
+        if b, e := ioutil.ReadFile("foo.out"); e != nil || string(b) != "bash\n" { t.Errorf("'%s' (%v)", b, e) }
+
+        // The `-e` flag stops the recipe at `false`.
+        captureStderr(func() { Update(ctx, "bar.log") })
+        if b, e := ioutil.ReadFile("bar.log"); e == nil { t.Errorf("'%s' is written", b) }
+}
+
+func TestBuildOneShell(t *testing.T) {
+        if wd, e := os.Getwd(); e != nil || workdir != wd { t.Errorf("%v != %v (%v)", workdir, wd, e) }
+
+        ctx, err := newTestContext("TestBuildOneShell", `
+.ONESHELL: foo.txt
+
+foo.txt:
+	@cd ..
+	-foo=$$(basename $$OLDPWD)
+	echo $$foo > build/$@
+bar.txt:
+	@foo=bar
+	echo "$$foo" > $@
+
+module foo
+me.oneshell := yes
+foobar.txt:
+	@cat > $@ <<EOF
+	foobar
+	EOF
+commit
+`);     if err != nil { t.Errorf("parse error: %v", err) }
+        if s, x := ctx.g.goal, "foo.txt"; s != x { t.Errorf("goal: %v != %v", s, x) }
+
+        os.Remove("foo.txt")
+        os.Remove("bar.txt")
+        os.Remove("foobar.txt")
+        Update(ctx, "foo.txt", "foo", "bar.txt")
+        if b, e := ioutil.ReadFile("foo.txt"); e != nil { t.Errorf("%v", e) } else {
+                if s, x := string(b), "build\n"; s != x { t.Errorf("'%v' != '%v'", s, x) }
+        }
+        if b, e := ioutil.ReadFile("bar.txt"); e != nil { t.Errorf("%v", e) } else {
+                if s, x := string(b), "\n"; s != x { t.Errorf("'%v' != '%v'", s, x) }
+        }
+        if b, e := ioutil.ReadFile("foobar.txt"); e != nil { t.Errorf("%v", e) } else {
+                if s, x := string(b), "foobar\n"; s != x { t.Errorf("'%v' != '%v'", s, x) }
+        }
+
+        os.Remove("foo.txt")
+        os.Remove("bar.txt")
+        os.Remove("foobar.txt")
+}
+
+func TestBuildDeleteOnError(t *testing.T) {
+        if wd, e := os.Getwd(); e != nil || workdir != wd { t.Errorf("%v != %v (%v)", workdir, wd, e) }
+
+        ctx, err := newTestContext("TestBuildDeleteOnError", `
+.DELETE_ON_ERROR:
+.PRECIOUS: %.log
+
+foo.txt:
+	@echo partial > $@
+	@false
+foo.log:
+	@echo partial > $@; false
+`);     if err != nil { t.Errorf("parse error: %v", err) }
+
+        os.Remove("foo.txt")
+        os.Remove("foo.log")
+        defer os.Remove("foo.txt")
+        defer os.Remove("foo.log")
+        Update(ctx, "foo.txt")
+        Update(ctx, "foo.log")
+        if _, e := os.Stat("foo.txt"); e == nil { t.Errorf("foo.txt is not deleted") }
+        if _, e := os.Stat("foo.log"); e != nil { t.Errorf("foo.log is deleted: %v", e) }
+
+        // Like make, targets are kept without .DELETE_ON_ERROR.
+        ctx, err = newTestContext("TestBuildDeleteOnError", `
+foo.txt:
+	@echo partial > $@; false
+`);     if err != nil { t.Errorf("parse error: %v", err) }
+        Update(ctx, "foo.txt")
+        if _, e := os.Stat("foo.txt"); e != nil { t.Errorf("foo.txt is deleted: %v", e) }
+
+        defer SetFlagDeleteOnError(GetFlagDeleteOnError())
+        SetFlagDeleteOnError(true)
+        os.Remove("foo.txt")
+        Update(ctx, "foo.txt")
+        if _, e := os.Stat("foo.txt"); e == nil { t.Errorf("foo.txt is not deleted") }
+}
+
+func TestBuildInterrupt(t *testing.T) {
+        if wd, e := os.Getwd(); e != nil || workdir != wd { t.Errorf("%v != %v (%v)", workdir, wd, e) }
+
+        os.Remove("foo.txt")
+        os.Remove("bar.txt")
+        defer os.Remove("foo.txt")
+        defer os.Remove("bar.txt")
+
+        // Commands started by the shell are also killed.
+        job := &executeRecipes{ target:"foo.txt", dir:workdir, targets:map[string]time.Time{ "foo.txt":time.Time{} } }
+        cmd := exec.Command("sh", "-c", "echo partial > foo.txt; (sleep 0.3; touch bar.txt) & wait")
+        done := make(chan error)
+        go func() { done <- job.run(cmd) }()
+        time.Sleep(100*time.Millisecond)
+        captureStderr(killJobs)
+        if e := <-done; e == nil { t.Errorf("not killed") }
+        time.Sleep(400*time.Millisecond)
+        if _, e := os.Stat("bar.txt"); e == nil { t.Errorf("bar.txt is written") }
+        if _, e := os.Stat("foo.txt"); e == nil { t.Errorf("foo.txt is not deleted") }
+}
+
+func TestBuildModes(t *testing.T) {
+        if wd, e := os.Getwd(); e != nil || workdir != wd { t.Errorf("%v != %v (%v)", workdir, wd, e) }
+
+        defer SetFlagN(GetFlagN())
+        defer SetFlagQ(GetFlagQ())
+        defer SetFlagTouch(GetFlagTouch())
+
+        so := jobStdout
+        defer func() { jobStdout = so }()
+        out := new(bytes.Buffer)
+        jobStdout = out
+
+        ctx, err := newTestContext("TestBuildModes", `
+foo.txt: bar.txt
+	@cat $< > $@
+	+@echo forced >> foo.log
+bar.txt:
+	echo bar > $@
+check:!: foo.txt
+	@echo checked >> foo.log
+`);     if err != nil { t.Errorf("parse error: %v", err) }
+
+        for _, s := range []string{ "foo.txt", "bar.txt", "foo.log" } {
+                os.Remove(s)
+                defer os.Remove(s)
+        }
+        exists := func(s string) bool { _, e := os.Stat(s); return e == nil }
+        log := func() string { b, _ := ioutil.ReadFile("foo.log"); return string(b) }
+
+        // Recipes are printed but not executed, except '+' ones.
+        SetFlagN(true)
+        Update(ctx, "check")
+        if s, x := out.String(), "echo bar > bar.txt\ncat bar.txt > foo.txt\necho checked >> foo.log\n"; s != x { t.Errorf("'%v' != '%v'", s, x) }
+        if exists("bar.txt") || exists("foo.txt") { t.Errorf("targets are updated") }
+        if s, x := log(), "forced\n"; s != x { t.Errorf("'%v' != '%v'", s, x) }
+        SetFlagN(false)
+
+        // Only '+' recipes are executed in question mode.
+        out.Reset()
+        SetFlagQ(true)
+        Update(ctx, "foo.txt")
+        if !ctx.stale { t.Errorf("foo.txt is up to date") }
+        if exists("bar.txt") || exists("foo.txt") { t.Errorf("targets are updated") }
+        if s, x := out.String() + log(), "forced\nforced\n"; s != x { t.Errorf("'%v' != '%v'", s, x) }
+        SetFlagQ(false)
+
+        Update(ctx, "foo.txt")
+        os.Remove("foo.log")
+        SetFlagQ(true)
+        Update(ctx, "foo.txt")
+        if ctx.stale { t.Errorf("foo.txt is not up to date") }
+        SetFlagQ(false)
+
+        // Targets are touched instead of updated.
+        out.Reset()
+        future := time.Now().Add(time.Hour)
+        os.Chtimes("bar.txt", future, future)
+        ioutil.WriteFile("bar.txt", []byte("changed\n"), 0644)
+        os.Chtimes("bar.txt", future, future)
+        SetFlagTouch(true)
+        Update(ctx, "foo.txt")
+        if s, x := out.String() + log(), "touch foo.txt\nforced\n"; s != x { t.Errorf("'%v' != '%v'", s, x) }
+        if b, e := ioutil.ReadFile("foo.txt"); e != nil || string(b) != "bar\n" { t.Errorf("'%s' (%v)", b, e) }
+        if fi, e := os.Stat("foo.txt"); e != nil || fi.ModTime().Before(time.Now().Add(-time.Minute)) { t.Errorf("not touched: %v", e) }
+        SetFlagTouch(false)
+}
+
+func TestBuildExplain(t *testing.T) {
+        if wd, e := os.Getwd(); e != nil || workdir != wd { t.Errorf("%v != %v (%v)", workdir, wd, e) }
+
+        defer SetFlagExplain(GetFlagExplain())
+        SetFlagExplain(true)
+
+        ctx, err := newTestContext("TestBuildExplain", `
+all:!: foo.out bar.out check
+%.out: %.in
+	@cp $< $@
+foo.in:
+bar.in:
+	@touch $@
+check:!:
+	@touch check.txt
+check:?:
+	@test -f check.txt
+`);     if err != nil { t.Errorf("parse error: %v", err) }
+
+        for _, s := range []string{ "foo.in", "foo.out", "bar.in", "bar.out", "check.txt" } {
+                os.Remove(s)
+                defer os.Remove(s)
+        }
+        ioutil.WriteFile("foo.in", []byte("foo\n"), 0644)
+
+        check := func(x ...string) {
+                s := captureStderr(func() { Update(ctx, "all") })
+                for _, x := range x {
+                        if !strings.Contains(s, x + "\n") { t.Errorf("missing '%v' in:\n%v", x, s) }
+                }
+        }
+        check(
+                "TestBuildExplain:2:1: 'all': update: phony target",
+                "TestBuildExplain:3:1: 'foo.out' (stem 'foo'): update: target is missing",
+                "TestBuildExplain:6:1: 'bar.in': update: target is missing",
+                "TestBuildExplain:8:1: 'check': update: checker rule at TestBuildExplain:10:1 failed",
+        )
+
+        future := time.Now().Add(time.Hour)
+        os.Chtimes("foo.in", future, future)
+        os.Remove("bar.in")
+        check(
+                "TestBuildExplain:3:1: 'foo.out' (stem 'foo'): update: prerequisite 'foo.in' is newer",
+                "TestBuildExplain:3:1: 'bar.out' (stem 'bar'): update: prerequisite 'bar.in' is rebuilt",
+                "TestBuildExplain:8:1: 'check': checker rules passed",
+        )
+        check(
+                "TestBuildExplain:5:1: 'foo.in': up to date",
+                "TestBuildExplain:3:1: 'bar.out' (stem 'bar'): up to date",
+                "TestBuildExplain:6:1: 'bar.in': up to date",
+        )
+}
+
+func TestBuildTargetDirs(t *testing.T) {
+        if wd, e := os.Getwd(); e != nil || workdir != wd { t.Errorf("%v != %v (%v)", workdir, wd, e) }
+
+        info, f := new(bytes.Buffer), builtinInfoFunc; defer func(){ builtinInfoFunc = f }()
+        builtinInfoFunc = func(ctx *Context, args Items) {
+                fmt.Fprintf(info, "%v\n", args.Expand(ctx))
+        }
+
+        ctx, err := newTestContext("TestBuildTargetDirs", `
+.MKDIR: out/a/%
+
+out/a/foo.txt: out/
+	@echo foo > $@ $(info 1: $@ $(@D))
+out/:
+	@test -d $@ $(info 2: $@)
+`);     if err != nil { t.Errorf("parse error: %v", err) }
+
+        os.RemoveAll("out")
+        Update(ctx)
+        if s, x := info.String(), "2: out/\n1: out/a/foo.txt out/a\n"; s != x { t.Errorf("'%s' != '%s'", s, x) }
+        if _, e := os.Stat("out/a/foo.txt"); e != nil { t.Errorf("%v", e) }
+
+        // The directory is newer than the target.
+        info.Reset()
+        past, tt := time.Now().Add(-time.Hour), time.Now()
+        if e := os.Chtimes("out/a/foo.txt", past, past); e != nil { t.Errorf("%v", e) }
+        if e := os.Chtimes("out", tt, tt); e != nil { t.Errorf("%v", e) }
+        Update(ctx)
+        if s, x := info.String(), ""; s != x { t.Errorf("'%s' != '%s'", s, x) }
+
+        os.RemoveAll("out")
+}
+
+func TestBuildPatternRules(t *testing.T) {
+        if wd, e := os.Getwd(); e != nil || workdir != wd { t.Errorf("%v != %v (%v)", workdir, wd, e) }
+
+        ctx, err := newTestContext("TestBuildPatternRules", `
+all:!: foo.o lib/bar.o baz.o
+%.o: %.c
+	@echo c $* > $@
+lib/%.o: %.c
+	@echo lib $* > $@
+%.o: %.s
+	@echo s $* > $@
+`);     if err != nil { t.Errorf("parse error: %v", err) }
+
+        os.MkdirAll("lib", 0755)
+        defer os.RemoveAll("lib")
+        for _, s := range []string{ "foo.s", "bar.c", "baz.c", "baz.s", "foo.o", "baz.o" } {
+                os.Remove(s)
+                defer os.Remove(s)
+        }
+        for _, s := range []string{ "foo.s", "bar.c", "baz.c", "baz.s" } {
+                ioutil.WriteFile(s, []byte(s), 0644)
+        }
+
+        s := captureStderr(func() { Update(ctx, "all") })
+        for _, c := range []struct{ name, content string }{
+                { "foo.o", "s foo\n" }, // prerequisites exist
+                { "lib/bar.o", "lib bar\n" }, // shortest stem
+                { "baz.o", "c baz\n" }, // first declared
+        } {
+                if b, e := ioutil.ReadFile(c.name); e != nil || string(b) != c.content { t.Errorf("%v: '%s' != '%v' (%v)", c.name, b, c.content, e) }
+        }
+        if x := "TestBuildPatternRules:3:1:warning: ambiguous pattern rules to make 'baz.o'\n"; !strings.Contains(s, x) { t.Errorf("missing '%v' in '%v'", x, s) }
+        if x := "TestBuildPatternRules:7:1: %.o (selected)\n"; strings.Contains(s, x) { t.Errorf("'%v' in '%v'", x, s) }
+        if n := strings.Count(s, "ambiguous"); n != 1 { t.Errorf("%v warnings: '%v'", n, s) }
+
+        // It's an error in strict mode.
+        defer SetFlagStrict(GetFlagStrict())
+        SetFlagStrict(true)
+        os.Remove("baz.o")
+        s = captureStderr(func() {
+                defer func() {
+                        if e, ok := recover().(*smarterror); !ok || !strings.Contains(e.message, "ambiguous pattern rules to make 'baz.o'") { t.Errorf("error: %v", e) }
+                }()
+                Update(ctx, "all")
+        })
+        if x := "TestBuildPatternRules:3:1:error: ambiguous pattern rules to make 'baz.o'\n"; !strings.Contains(s, x) { t.Errorf("missing '%v' in '%v'", x, s) }
+        if _, e := os.Stat("baz.o"); e == nil { t.Errorf("baz.o is updated") }
+}
+
+func TestBuildAutomaticVariables(t *testing.T) {
+        if wd, e := os.Getwd(); e != nil || workdir != wd { t.Errorf("%v != %v (%v)", workdir, wd, e) }
+
+        info, f := new(bytes.Buffer), builtinInfoFunc; defer func(){ builtinInfoFunc = f }()
+        builtinInfoFunc = func(ctx *Context, args Items) {
+                fmt.Fprintf(info, "%v\n", args.Expand(ctx))
+        }
+
+        ctx, err := newTestContext("TestBuildAutomaticVariables", `
+all:!: foo.a bar.a foo.a lib.a(foo.a)
+	@true $(info $<|$^|$+|$(+F)|$%)
+foo.a bar.a:
+	@touch $@
+lib.a(foo.a):
+	@true $(info $@|$%|$(%D)|$(%F))
+`);     if err != nil { t.Errorf("parse error: %v", err) }
+
+        for _, s := range []string{ "foo.a", "bar.a" } {
+                os.Remove(s)
+                defer os.Remove(s)
+        }
+        Update(ctx, "all")
+        if s, x := info.String(), "lib.a|foo.a|.|foo.a\nfoo.a|foo.a bar.a|foo.a bar.a foo.a foo.a|foo.a bar.a foo.a foo.a|\n"; s != x { t.Errorf("'%s' != '%s'", s, x) }
+}
+
+func TestBuildArchiveMembers(t *testing.T) {
+        if wd, e := os.Getwd(); e != nil || workdir != wd { t.Errorf("%v != %v (%v)", workdir, wd, e) }
+        if _, err := exec.LookPath("ar"); err != nil { t.Skipf("ar: %v", err) }
+
+        // Like GNU make, members of the same archive can't be updated in
+        // parallel.
+        defer SetFlagJ(GetFlagJ())
+        SetFlagJ(1)
+
+        ctx, err := newTestContext("TestBuildArchiveMembers", `
+libfoo.a: libfoo.a(foo.o bar.o)
+	@echo $? >> ar.log
+libfoo.a(%.o): %.o
+	@ar rU $@ $% 2>/dev/null
+foo.o bar.o:
+`);     if err != nil { t.Errorf("parse error: %v", err) }
+
+        for _, s := range []string{ "foo.o", "bar.o", "libfoo.a", "ar.log" } {
+                os.Remove(s)
+                defer os.Remove(s)
+        }
+        past := time.Now().Add(-time.Hour)
+        for _, s := range []string{ "foo.o", "bar.o" } {
+                ioutil.WriteFile(s, []byte(s), 0644)
+                os.Chtimes(s, past, past)
+        }
+        check := func(x string) {
+                Update(ctx, "libfoo.a")
+                if b, e := ioutil.ReadFile("ar.log"); e != nil || string(b) != x { t.Errorf("'%s' != '%v' (%v)", b, x, e) }
+        }
+        check("foo.o bar.o\n")
+        if fi, e := statFile("libfoo.a(bar.o)"); e != nil || fi.ModTime().Unix() != past.Unix() { t.Errorf("%v (%v)", fi, e) }
+        check("foo.o bar.o\n")
+
+        // Only the member older than the object is replaced.
+        now := time.Now()
+        os.Chtimes("bar.o", now, now)
+        check("foo.o bar.o\nbar.o\n")
+        check("foo.o bar.o\nbar.o\n")
+
+        // The member date is touched in the archive with -t.
+        defer SetFlagTouch(GetFlagTouch())
+        SetFlagTouch(true)
+        future := time.Now().Add(time.Hour)
+        os.Chtimes("foo.o", future, future)
+        so, out := jobStdout, new(bytes.Buffer)
+        defer func() { jobStdout = so }()
+        jobStdout = out
+        check("foo.o bar.o\nbar.o\n")
+        if s, x := out.String(), "touch libfoo.a(foo.o)\ntouch libfoo.a\n"; s != x { t.Errorf("'%v' != '%v'", s, x) }
+        if _, e := os.Stat("libfoo.a(foo.o)"); !os.IsNotExist(e) { t.Errorf("member is created as a file (%v)", e) }
+        if fi, e := statFile("libfoo.a(foo.o)"); e != nil || fi.ModTime().Unix() < now.Unix() { t.Errorf("%v (%v)", fi, e) }
+        SetFlagTouch(false)
+        os.Chtimes("foo.o", now, now)
+        check("foo.o bar.o\nbar.o\n")
+}
+
+func TestBuildVpath(t *testing.T) {
+        if wd, e := os.Getwd(); e != nil || workdir != wd { t.Errorf("%v != %v (%v)", workdir, wd, e) }
+
+        ctx, err := newTestContext("TestBuildVpath", `
+VPATH = vsrc:none
+vpath %.h vinc
+vpath %.c none
+vpath %.c
+foo.o: foo.c foo.h bar.h
+	@echo $< $^ > $@
+bar.h:
+`);     if err != nil { t.Errorf("parse error: %v", err) }
+        if n := len(ctx.g.vpaths); n != 1 { t.Errorf("vpaths: %v", n) }
+
+        for _, s := range []string{ "vsrc", "vinc" } {
+                os.MkdirAll(s, 0755)
+                defer os.RemoveAll(s)
+        }
+        for _, s := range []string{ "vsrc/foo.c", "vinc/foo.h", "vinc/bar.h" } {
+                ioutil.WriteFile(s, []byte(s), 0644)
+        }
+        os.Remove("foo.o")
+        defer os.Remove("foo.o")
+
+        check := func(x string) {
+                Update(ctx, "foo.o")
+                if b, e := ioutil.ReadFile("foo.o"); e != nil || string(b) != x { t.Errorf("'%s' != '%v' (%v)", b, x, e) }
+        }
+        check("vsrc/foo.c vsrc/foo.c vinc/foo.h vinc/bar.h\n")
+
+        // Updated if the found prerequisite is newer.
+        ioutil.WriteFile("foo.o", []byte("old\n"), 0644)
+        check("old\n")
+        future := time.Now().Add(time.Hour)
+        os.Chtimes("vinc/foo.h", future, future)
+        check("vsrc/foo.c vsrc/foo.c vinc/foo.h vinc/bar.h\n")
+
+        // Prerequisites here are preferred.
+        ioutil.WriteFile("foo.c", []byte("foo.c"), 0644)
+        defer os.Remove("foo.c")
+        os.Chtimes("foo.c", future, future)
+        check("foo.c foo.c vinc/foo.h vinc/bar.h\n")
+}
+
+func TestBuildSecondExpansion(t *testing.T) {
+        if wd, e := os.Getwd(); e != nil || workdir != wd { t.Errorf("%v != %v (%v)", workdir, wd, e) }
+
+        ctx, err := newTestContext("TestBuildSecondExpansion", `
+all:!: out/foo.o
+nothing.o: $$@.src
+.SECONDEXPANSION:
+%.o: $$(@D)/.dirstamp $$(dir $$@)/$$(*F).src %.h
+	@echo $@ $* $^ > $@
+%/.dirstamp:
+	@touch $@
+out/foo.src out/foo.h:
+
+module foo
+me.name := foo
+foo.txt: $$(me.name).in
+	@cat $< > $@
+foo.in:
+commit
+`);     if err != nil { t.Errorf("parse error: %v", err) }
+        if r := ctx.g.files["nothing.o"]; r == nil || r.expansion != nil || strings.Join(r.prerequisites, " ") != "$@.src" { t.Errorf("expanded before .SECONDEXPANSION: %v", r) }
+
+        os.MkdirAll("out", 0755)
+        defer os.RemoveAll("out")
+        for _, s := range []string{ "out/foo.src", "out/foo.h", "foo.in" } {
+                ioutil.WriteFile(s, []byte(s), 0644)
+        }
+        defer os.Remove("foo.in")
+        defer os.Remove("foo.txt")
+
+        Update(ctx, "all")
+        if b, e := ioutil.ReadFile("out/foo.o"); e != nil || string(b) != "out/foo.o out/foo out/.dirstamp out/foo.src out/foo.h\n" { t.Errorf("'%s' (%v)", b, e) }
+
+        os.Remove("foo.txt")
+        Update(ctx, "foo")
+        if b, e := ioutil.ReadFile("foo.txt"); e != nil || string(b) != "foo.in" { t.Errorf("'%s' (%v)", b, e) }
+}
+
+func TestBuildRuleScope(t *testing.T) {
+        if wd, e := os.Getwd(); e != nil || workdir != wd { t.Errorf("%v != %v (%v)", workdir, wd, e) }
+
+        ctx, err := newTestContext("TestBuildRuleScope", `
+.SECONDEXPANSION:
+module foo
+me.x := foo
+foo.txt: $$(me.x).in
+	@echo $(me.x) $^ > $@
+foo.in:
+commit
+module bar
+me.x := bar
+commit
+`);     if err != nil { t.Errorf("parse error: %v", err) }
+
+        foo, bar := ctx.modules["foo"], ctx.modules["bar"]
+        if foo == nil || bar == nil { t.Fatalf("modules: %v", ctx.modules) }
+        r := foo.files["foo.txt"]
+        if r == nil || r.module != foo { t.Fatalf("rule: %v", r) }
+
+        ioutil.WriteFile("foo.in", []byte("foo\n"), 0644)
+        os.Remove("foo.txt")
+        defer os.Remove("foo.in")
+        defer os.Remove("foo.txt")
+
+        // Updated while another module is current.
+        ctx.beginUpdate()
+        ctx.m = bar
+        r.update(ctx, &match{ target:"foo.txt" })
+        if ctx.m != bar { t.Errorf("module is not restored: %v", ctx.m) }
+        ctx.m = nil
+        ctx.endUpdate()
+        if b, e := ioutil.ReadFile("foo.txt"); e != nil || string(b) != "foo foo.in\n" { t.Errorf("'%s' (%v)", b, e) }
+}
+
+func TestBuildQualifiedTargets(t *testing.T) {
+        if wd, e := os.Getwd(); e != nil || workdir != wd { t.Errorf("%v != %v (%v)", workdir, wd, e) }
+
+        dir := filepath.Join(workdir, "qualified")
+        os.MkdirAll(dir, 0755)
+        defer os.RemoveAll(dir)
+        defer os.Remove("all.txt")
+
+        ctx, err := newTestContext("TestBuildQualifiedTargets", fmt.Sprintf(`
+module foo
+me.workdir := %s
+foo.txt:
+	@echo foo > $@
+%%.gen:
+	@echo $* > $@
+bad.txt:
+	@false
+commit
+all.txt: foo:foo.txt foo:bar.gen
+	@cat $^ > $@
+`, dir));     if err != nil { t.Errorf("parse error: %v", err) }
+
+        // Made in the working directory of module foo.
+        Update(ctx, "all.txt")
+        if wd, e := os.Getwd(); e != nil || workdir != wd { t.Errorf("%v != %v (%v)", workdir, wd, e) }
+        if b, e := ioutil.ReadFile("all.txt"); e != nil || string(b) != "foo\nbar\n" { t.Errorf("'%s' (%v)", b, e) }
+        if _, e := os.Stat(filepath.Join(dir, "foo.txt")); e != nil { t.Errorf("%v", e) }
+        if _, e := os.Stat("foo.txt"); e == nil { t.Errorf("foo.txt is made here") }
+
+        os.Remove(filepath.Join(dir, "foo.txt"))
+        Update(ctx, "foo:foo.txt")
+        if b, e := ioutil.ReadFile(filepath.Join(dir, "foo.txt")); e != nil || string(b) != "foo\n" { t.Errorf("'%s' (%v)", b, e) }
+
+        s := captureStderr(func() { Update(ctx, "foo:bad.txt") })
+        if !strings.Contains(s, "recipe for 'foo:bad.txt' failed") { t.Errorf("'%v'", s) }
+        if len(ctx.failures) != 1 || ctx.failures[0].target != "foo:bad.txt" { t.Errorf("failures: %v", ctx.failures) }
+}
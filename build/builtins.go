@@ -56,7 +56,7 @@ func builtinDir(ctx *Context, loc location, args Items) (is Items) {
 }
 
 func builtinInfo(ctx *Context, loc location, args Items) (is Items) {
-        if builtinInfoFunc != nil {
+        if builtinInfoFunc != nil && !ctx.quiet {
                 builtinInfoFunc(ctx, args)
         }
         return
@@ -0,0 +1,563 @@
+//
+//  Copyright (C) 2012-2016, Duzy Chan <code@duzy.info>, all rights reserverd.
+//
+package smart
+
+import (
+        "bytes"
+        "crypto/sha1"
+        "encoding/hex"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "io"
+        "io/ioutil"
+        "os"
+        "path/filepath"
+        "sort"
+        "strings"
+        "sync"
+        "time"
+)
+
+// The action cache keeps outputs of recipes by the hash of the expanded
+// recipes, variables used by them, contents of the prerequisites and the
+// environment variables declared in `.CACHE_ENV`, so the same targets built
+// in other checkouts are restored instead of running the recipes. It's
+// enabled by `-cache=dir` or the environment variable `SMART_CACHE`.
+//
+//      .CACHE_ENV := CC PATH
+//
+// Action results are kept in `ac/` by the key, and the outputs are kept in
+// `cas/` by their content hashes. Dependencies from the depfile are recorded
+// in the result with their hashes, the result is not used if any of them is
+// changed. A remote cache (see remote.go) is checked if the local cache
+// misses, or used alone without the local directory.
+
+var errNotCached = errors.New("not cached")
+
+// errBrokenContent is the error of writeFileSum if the sum mismatches.
+var errBrokenContent = errors.New("content mismatches the sum")
+
+// actionCache is a local cache directory, and/or a remote cache.
+type actionCache struct {
+        dir string // "" if only the remote cache is used
+        limit int64
+        remote *remoteCache
+
+        mu sync.Mutex // guards the counters, actions are restored in parallel
+        hits, remoteHits, misses, stores int
+}
+
+// actionResult is the result of an action kept in the cache.
+type actionResult struct {
+        Outputs []*actionOutput `json:"outputs"`
+        Depends map[string]string `json:"depends,omitempty"` // name -> sum
+}
+
+type actionOutput struct {
+        Name string `json:"name"`
+        Sum string `json:"sum"`
+        Mode os.FileMode `json:"mode"`
+}
+
+// cacheStats is the statistics kept in the cache.
+type cacheStats struct {
+        Hits int `json:"hits"`
+        RemoteHits int `json:"remote_hits"`
+        Misses int `json:"misses"`
+        Stores int `json:"stores"`
+        Evictions int `json:"evictions"`
+}
+
+// cacheDir returns the cache directory, or "" if the cache is disabled.
+func cacheDir() string {
+        if *flagCache != "" {
+                return *flagCache
+        }
+        return os.Getenv("SMART_CACHE")
+}
+
+// openCache returns the cache, or nil if the cache is disabled.
+func openCache() *actionCache {
+        dir, remote := cacheDir(), openRemoteCache()
+        if dir != "" || remote != nil {
+                return &actionCache{ dir:dir, limit:*flagCacheSize << 20, remote:remote }
+        }
+        return nil
+}
+
+func (c *actionCache) resultPath(key string) string {
+        return filepath.Join(c.dir, "ac", key[:2], key)
+}
+
+func (c *actionCache) blobPath(sum string) string {
+        return filepath.Join(c.dir, "cas", sum[:2], sum)
+}
+
+func (c *actionCache) statsPath() string {
+        return filepath.Join(c.dir, "stats")
+}
+
+// cacheKey computes the key of the action, prerequisites which are not files
+// (e.g. phony) are not included.
+func (r *rule) cacheKey(ctx *Context, command, vars string, prerequisites []string) string {
+        h := sha1.New()
+        fmt.Fprintf(h, "command:%s\nvars:%s\n", command, vars)
+        for _, s := range prerequisites {
+                if isDirTarget(s) { continue }
+                name := s
+                if archive, _, ok := splitArchiveMember(s); ok {
+                        name = archive // members are not hashed separately
+                }
+                if sum, err := sumFile(name); err == nil {
+                        fmt.Fprintf(h, "input:%s=%s\n", s, sum)
+                }
+        }
+        if d, ok := ctx.g.defines[".CACHE_ENV"]; ok && d != nil {
+                for _, s := range Split(d.value.Expand(ctx)) {
+                        fmt.Fprintf(h, "env:%s=%s\n", s, os.Getenv(s))
+                }
+        }
+        return hex.EncodeToString(h.Sum(nil))
+}
+
+// sumFile returns the content hash of the file.
+func sumFile(name string) (sum string, err error) {
+        var f *os.File
+        if f, err = os.Open(name); err != nil {
+                return
+        }
+        defer f.Close()
+        if fi, e := f.Stat(); e != nil || fi.IsDir() {
+                return "", fmt.Errorf("'%v' is not a file", name)
+        }
+        h := sha1.New()
+        if _, err = io.Copy(h, f); err == nil {
+                sum = hex.EncodeToString(h.Sum(nil))
+        }
+        return
+}
+
+// writeFile writes the file atomically.
+func writeFile(name string, r io.Reader, mode os.FileMode) (err error) {
+        return writeFileSum(name, r, mode, "")
+}
+
+// writeFileSum writes the file atomically like writeFile, the content is
+// checked by the sum before it's renamed, unless the sum is "".
+func writeFileSum(name string, r io.Reader, mode os.FileMode, sum string) (err error) {
+        if err = os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+                return
+        }
+        var f *os.File
+        if f, err = ioutil.TempFile(filepath.Dir(name), ".tmp"); err != nil {
+                return
+        }
+        h := sha1.New()
+        if _, err = io.Copy(f, io.TeeReader(r, h)); err == nil {
+                err = f.Chmod(mode)
+        }
+        if s := hex.EncodeToString(h.Sum(nil)); err == nil && sum != "" && s != sum {
+                err = errBrokenContent
+        }
+        if e := f.Close(); err == nil {
+                err = e
+        }
+        if err == nil {
+                err = os.Rename(f.Name(), name)
+        }
+        if err != nil {
+                os.Remove(f.Name())
+        }
+        return
+}
+
+// installFile copies the file src to dst atomically.
+func installFile(dst, src string, mode os.FileMode) (err error) {
+        var f *os.File
+        if f, err = os.Open(src); err == nil {
+                defer f.Close()
+                err = writeFile(dst, f, mode)
+        }
+        return
+}
+
+// valid tells if none of the dependencies is changed.
+func (res *actionResult) valid() bool {
+        for name, sum := range res.Depends {
+                if s, err := sumFile(name); err != nil || s != sum {
+                        return false
+                }
+        }
+        return true
+}
+
+// checkOutputs checks that the outputs are the expected targets, so that a
+// forged result can't write other files.
+func (res *actionResult) checkOutputs(targets []string) error {
+        for _, out := range res.Outputs {
+                if !isOutputName(out.Name, targets) {
+                        return fmt.Errorf("unexpected output '%v'", out.Name)
+                } else if !isSum(out.Sum) {
+                        return fmt.Errorf("output '%v' has a bad sum '%v'", out.Name, out.Sum)
+                }
+        }
+        return nil
+}
+
+// isSum tells if the string is a SHA-1 sum in hex.
+func isSum(s string) bool {
+        _, err := hex.DecodeString(s)
+        return err == nil && len(s) == 2*sha1.Size
+}
+
+// isOutputName tells if the name is one of the targets, absolute names and
+// names having `..` are never outputs.
+func isOutputName(name string, targets []string) bool {
+        if name == "" || filepath.IsAbs(name) {
+                return false
+        }
+        for _, s := range strings.Split(filepath.ToSlash(name), "/") {
+                if s == ".." { return false }
+        }
+        for _, t := range targets {
+                if t == name { return true }
+        }
+        return false
+}
+
+// get returns the action result of the key in the local cache, it's nil if
+// the result is not cached or any dependency is changed.
+func (c *actionCache) get(key string) (res *actionResult) {
+        if c.dir == "" {
+                return nil
+        }
+        b, err := ioutil.ReadFile(c.resultPath(key))
+        if err != nil {
+                return nil
+        }
+        if err = json.Unmarshal(b, &res); err != nil || res == nil || !res.valid() {
+                return nil
+        }
+        for _, out := range res.Outputs {
+                if !isSum(out.Sum) {
+                        return nil
+                } else if _, err := os.Stat(c.blobPath(out.Sum)); err != nil {
+                        return nil // evicted
+                }
+        }
+        return
+}
+
+// restore restores outputs of the action if it's cached, the outputs must be
+// the targets.
+func (c *actionCache) restore(key string, targets []string) (res *actionResult, err error) {
+        if res = c.get(key); res != nil {
+                if err = res.checkOutputs(targets); err != nil {
+                        c.count(&c.misses)
+                        return nil, err
+                }
+                now := time.Now()
+                os.Chtimes(c.resultPath(key), now, now)
+                for _, out := range res.Outputs {
+                        blob := c.blobPath(out.Sum)
+                        if err = installFile(out.Name, blob, out.Mode); err != nil {
+                                return nil, err
+                        }
+                        os.Chtimes(blob, now, now)
+                }
+                c.count(&c.hits)
+                return
+        }
+        if res, err = c.restoreRemote(key, targets); res != nil && err == nil {
+                c.count(&c.remoteHits)
+                return
+        }
+        c.count(&c.misses)
+        return nil, err
+}
+
+func (c *actionCache) count(n *int) {
+        c.mu.Lock()
+        *n++
+        c.mu.Unlock()
+}
+
+// restoreRemote restores outputs of the action from the remote cache, they
+// are also kept in the local cache. Results from the remote cache are not
+// trusted, the outputs must be the targets.
+func (c *actionCache) restoreRemote(key string, targets []string) (res *actionResult, err error) {
+        if res = c.remote.get(key); res == nil || !res.valid() {
+                return nil, nil
+        }
+        if err = res.checkOutputs(targets); err != nil {
+                return nil, err
+        }
+        for _, out := range res.Outputs {
+                if c.dir == "" {
+                        if c.remote.fetch(out.Name, out.Sum, out.Mode) != nil {
+                                return nil, nil // warned and built locally
+                        }
+                } else if c.remote.fetch(c.blobPath(out.Sum), out.Sum, 0644) != nil {
+                        return nil, nil
+                } else if err = installFile(out.Name, c.blobPath(out.Sum), out.Mode); err != nil {
+                        return nil, err
+                }
+        }
+        if c.dir != "" {
+                err = c.putResult(key, res)
+        }
+        return
+}
+
+func (c *actionCache) putResult(key string, res *actionResult) (err error) {
+        var b []byte
+        if b, err = json.Marshal(res); err == nil {
+                err = writeFile(c.resultPath(key), bytes.NewReader(b), 0644)
+        }
+        return
+}
+
+// store stores outputs of the action.
+func (c *actionCache) store(key string, outputs, depends []string) (err error) {
+        res := &actionResult{}
+        for _, name := range outputs {
+                var fi os.FileInfo
+                if fi, err = os.Stat(name); err != nil {
+                        return
+                }
+                out := &actionOutput{ Name:name, Mode:fi.Mode().Perm() }
+                if out.Sum, err = sumFile(name); err != nil {
+                        return
+                }
+                if c.dir == "" {
+                        // not kept locally
+                } else if _, e := os.Stat(c.blobPath(out.Sum)); e != nil {
+                        if err = installFile(c.blobPath(out.Sum), name, 0644); err != nil {
+                                return
+                        }
+                }
+                res.Outputs = append(res.Outputs, out)
+        }
+        for _, name := range depends {
+                if sum, e := sumFile(name); e == nil {
+                        if res.Depends == nil { res.Depends = make(map[string]string) }
+                        res.Depends[name] = sum
+                }
+        }
+        if c.dir != "" {
+                if err = c.putResult(key, res); err != nil {
+                        return
+                }
+        }
+        c.remote.store(key, res)
+        c.count(&c.stores)
+        return
+}
+
+// unlockCache runs f (restoring or storing outputs) without holding the
+// context, so that other jobs are not blocked by the (remote) cache.
+func (ctx *Context) unlockCache(f func()) {
+        if jobs.serial() {
+                f()
+        } else {
+                ctx.unlockWhile(f)
+        }
+}
+
+// isCacheable tells if the targets of the match can be cached, archive
+// members are not files to be cached.
+func (r *rule) isCacheable(m *match) bool {
+        for _, t := range r.groupTargets(m) {
+                if _, _, ok := splitArchiveMember(t); ok {
+                        return false
+                }
+        }
+        return true
+}
+
+// restoreCache restores the targets of the match from the cache, it returns
+// errNotCached if they're not cached.
+func (r *rule) restoreCache(ctx *Context, key string, m *match) error {
+        var res *actionResult
+        var err error
+        targets := r.groupTargets(m)
+        ctx.unlockCache(func() { res, err = ctx.cache.restore(key, targets) })
+        if err != nil {
+                s, lineno, colno := r.getLocation()
+                fmt.Fprintf(os.Stderr, "%v:%v:%v:warning: cache: %v\n", s, lineno, colno, err)
+                return errNotCached
+        } else if res == nil {
+                return errNotCached
+        }
+        debug("restored '%v' from cache", m.target)
+        var depends []string
+        for s := range res.Depends {
+                depends = append(depends, s)
+        }
+        sort.Strings(depends)
+        ctx.db.recordDepends(r.groupTargets(m), depends)
+        return nil
+}
+
+// storeCache stores the targets of the match into the cache.
+func (r *rule) storeCache(ctx *Context, key string, m *match) {
+        var outputs []string
+        for _, t := range r.groupTargets(m) {
+                if !isDirTarget(t) { outputs = append(outputs, t) }
+        }
+        var err error
+        depends := ctx.db.depends(m.target)
+        ctx.unlockCache(func() { err = ctx.cache.store(key, outputs, depends) })
+        if err != nil {
+                s, lineno, colno := r.getLocation()
+                fmt.Fprintf(os.Stderr, "%v:%v:%v:warning: cache: %v\n", s, lineno, colno, err)
+        }
+}
+
+func (c *actionCache) loadStats() (stats *cacheStats) {
+        stats = new(cacheStats)
+        if b, err := ioutil.ReadFile(c.statsPath()); err == nil {
+                json.Unmarshal(b, stats)
+        }
+        return
+}
+
+// close saves the statistics and evicts old entries if the cache is too
+// large.
+func (c *actionCache) close() (err error) {
+        if c == nil || c.dir == "" || c.hits + c.remoteHits + c.misses + c.stores == 0 {
+                return
+        }
+        stats := c.loadStats()
+        stats.Hits += c.hits
+        stats.RemoteHits += c.remoteHits
+        stats.Misses += c.misses
+        stats.Stores += c.stores
+        c.hits, c.remoteHits, c.misses, c.stores = 0, 0, 0, 0
+        if 0 < c.limit {
+                var n int
+                n, err = c.evict(c.limit)
+                stats.Evictions += n
+        }
+        if b, e := json.Marshal(stats); e == nil {
+                if e = writeFile(c.statsPath(), bytes.NewReader(b), 0644); err == nil {
+                        err = e
+                }
+        }
+        return
+}
+
+type cacheFile struct {
+        path string
+        size int64
+        mtime time.Time
+}
+
+// files returns entries and blobs in the cache.
+func (c *actionCache) files() (files []*cacheFile, err error) {
+        for _, sub := range []string{ "ac", "cas" } {
+                err = filepath.Walk(filepath.Join(c.dir, sub), func(path string, fi os.FileInfo, err error) error {
+                        if err != nil {
+                                if os.IsNotExist(err) { return nil }
+                                return err
+                        }
+                        if fi.Mode().IsRegular() {
+                                files = append(files, &cacheFile{ path, fi.Size(), fi.ModTime() })
+                        }
+                        return nil
+                })
+                if err != nil {
+                        return
+                }
+        }
+        return
+}
+
+// evict removes the least recently used files until the cache is not
+// larger than the limit.
+func (c *actionCache) evict(limit int64) (n int, err error) {
+        var files []*cacheFile
+        if files, err = c.files(); err != nil {
+                return
+        }
+        var size int64
+        for _, f := range files {
+                size += f.size
+        }
+        sort.Sort(byModTime(files))
+        for _, f := range files {
+                if size <= limit {
+                        break
+                }
+                if err = os.Remove(f.path); err != nil {
+                        return
+                }
+                size -= f.size
+                n++
+        }
+        return
+}
+
+type byModTime []*cacheFile
+func (a byModTime) Len() int           { return len(a) }
+func (a byModTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byModTime) Less(i, j int) bool { return a[i].mtime.Before(a[j].mtime) }
+
+// stats prints statistics of the cache.
+func (c *actionCache) stats(w io.Writer) (err error) {
+        var files []*cacheFile
+        if files, err = c.files(); err != nil {
+                return
+        }
+        var entries, blobs int
+        var size int64
+        for _, f := range files {
+                if strings.HasPrefix(f.path, filepath.Join(c.dir, "ac") + string(filepath.Separator)) {
+                        entries++
+                } else {
+                        blobs++
+                }
+                size += f.size
+        }
+        s := c.loadStats()
+        fmt.Fprintf(w, "cache directory: %v\n", c.dir)
+        fmt.Fprintf(w, "entries: %v\n", entries)
+        fmt.Fprintf(w, "blobs: %v\n", blobs)
+        fmt.Fprintf(w, "size: %v (limit %v)\n", size, c.limit)
+        fmt.Fprintf(w, "hits: %v\n", s.Hits)
+        fmt.Fprintf(w, "remote hits: %v\n", s.RemoteHits)
+        fmt.Fprintf(w, "misses: %v\n", s.Misses)
+        fmt.Fprintf(w, "stores: %v\n", s.Stores)
+        fmt.Fprintf(w, "evictions: %v\n", s.Evictions)
+        return
+}
+
+// clean removes everything in the cache.
+func (c *actionCache) clean() error {
+        for _, sub := range []string{ "ac", "cas", "stats" } {
+                if err := os.RemoveAll(filepath.Join(c.dir, sub)); err != nil {
+                        return err
+                }
+        }
+        return nil
+}
+
+// cacheCommand runs `smart cache stats|clean`.
+func cacheCommand(w io.Writer, args []string) (err error) {
+        dir := cacheDir()
+        if dir == "" {
+                return fmt.Errorf("cache is not enabled (use -cache=dir or SMART_CACHE)")
+        }
+        c := &actionCache{ dir:dir, limit:*flagCacheSize << 20 }
+        if len(args) != 1 {
+                return fmt.Errorf("usage: smart cache stats|clean")
+        }
+        switch args[0] {
+        case "stats": err = c.stats(w)
+        case "clean": err = c.clean()
+        default: err = fmt.Errorf("unknown cache command '%v'", args[0])
+        }
+        return
+}
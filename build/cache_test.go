@@ -0,0 +1,166 @@
+//
+//  Copyright (C) 2012-2016, Duzy Chan <code@duzy.info>, all rights reserverd.
+//
+package smart
+
+import (
+        "os"
+        "bytes"
+        "strings"
+        "testing"
+        "os/exec"
+        "io/ioutil"
+        "path/filepath"
+)
+
+func TestActionCache(t *testing.T) {
+        if wd, e := os.Getwd(); e != nil || workdir != wd { t.Errorf("%v != %v (%v)", workdir, wd, e) }
+
+        dir, err := ioutil.TempDir("", "smart-cache")
+        if err != nil { t.Fatalf("%v", err) }
+        defer os.RemoveAll(dir)
+        defer SetFlagCache(GetFlagCache())
+        SetFlagCache(dir)
+        os.Remove(databasePath())
+        defer os.Remove(databasePath())
+
+        ctx, err := newTestContext("TestActionCache", `
+foo.txt: bar.txt
+	@cat $< > $@; chmod +x $@; echo run >> foo.log
+bar.txt:
+`);     if err != nil { t.Errorf("parse error: %v", err) }
+
+        os.Remove("foo.txt")
+        os.Remove("foo.log")
+        defer os.Remove("foo.txt")
+        defer os.Remove("foo.log")
+        defer os.Remove("bar.txt")
+
+        check := func(s, content string) {
+                if b, e := ioutil.ReadFile("foo.log"); e != nil || string(b) != s { t.Errorf("'%s' != '%v' (%v)", b, s, e) }
+                if b, e := ioutil.ReadFile("foo.txt"); e != nil || string(b) != content { t.Errorf("'%s' != '%v' (%v)", b, content, e) }
+        }
+
+        ioutil.WriteFile("bar.txt", []byte("bar\n"), 0644)
+        Update(ctx, "foo.txt")
+        check("run\n", "bar\n")
+
+        // Restored instead of running the recipe.
+        os.Remove("foo.txt")
+        Update(ctx, "foo.txt")
+        check("run\n", "bar\n")
+        if fi, e := os.Stat("foo.txt"); e != nil || fi.Mode().Perm() & 0100 == 0 { t.Errorf("mode is not restored: %v", fi) }
+
+        // The input is changed.
+        os.Remove("foo.txt")
+        ioutil.WriteFile("bar.txt", []byte("changed\n"), 0644)
+        Update(ctx, "foo.txt")
+        check("run\nrun\n", "changed\n")
+
+        // The first one is still cached.
+        os.Remove("foo.txt")
+        ioutil.WriteFile("bar.txt", []byte("bar\n"), 0644)
+        Update(ctx, "foo.txt")
+        check("run\nrun\n", "bar\n")
+
+        c := openCache()
+        if s := c.loadStats(); s.Hits != 2 || s.Misses != 2 || s.Stores != 2 { t.Errorf("stats: %+v", s) }
+
+        out := new(bytes.Buffer)
+        if err := cacheCommand(out, []string{ "stats" }); err != nil { t.Errorf("%v", err) }
+        for _, s := range []string{ "entries: 2\n", "blobs: 2\n", "hits: 2\n" } {
+                if !strings.Contains(out.String(), s) { t.Errorf("missing '%v' in:\n%v", s, out) }
+        }
+
+        if err := cacheCommand(out, []string{ "clean" }); err != nil { t.Errorf("%v", err) }
+        if files, _ := c.files(); len(files) != 0 { t.Errorf("not cleaned: %v", len(files)) }
+        if err := cacheCommand(out, []string{ "foo" }); err == nil { t.Errorf("unknown command is not reported") }
+}
+
+func TestActionCacheEvict(t *testing.T) {
+        dir, err := ioutil.TempDir("", "smart-cache")
+        if err != nil { t.Fatalf("%v", err) }
+        defer os.RemoveAll(dir)
+
+        c := &actionCache{ dir:dir }
+        name := "cache-input.txt"
+        defer os.Remove(name)
+        for _, s := range []string{ "a", "b", "c" } {
+                ioutil.WriteFile(name, []byte(strings.Repeat(s, 100)), 0644)
+                if err := c.store(s + strings.Repeat("0", 39), []string{ name }, nil); err != nil { t.Errorf("%v", err) }
+        }
+        files, _ := c.files()
+        if len(files) != 6 { t.Errorf("files: %v", len(files)) }
+
+        // Restoring makes it the most recently used one.
+        res, err := c.restore("a" + strings.Repeat("0", 39), []string{ name })
+        if err != nil || res == nil { t.Fatalf("not restored: %v", err) }
+
+        var size int64
+        for _, s := range []string{ c.resultPath("a" + strings.Repeat("0", 39)), c.blobPath(res.Outputs[0].Sum) } {
+                if fi, e := os.Stat(s); e == nil { size += fi.Size() }
+        }
+        if n, err := c.evict(size); err != nil || n != 4 { t.Errorf("evicted %v (%v)", n, err) }
+        if c.get("a" + strings.Repeat("0", 39)) == nil { t.Errorf("recently used is evicted") }
+        if c.get("b" + strings.Repeat("0", 39)) != nil { t.Errorf("least recently used is not evicted") }
+}
+
+func TestActionCacheOutputs(t *testing.T) {
+        dir, err := ioutil.TempDir("", "smart-cache")
+        if err != nil { t.Fatalf("%v", err) }
+        defer os.RemoveAll(dir)
+
+        c := &actionCache{ dir:dir }
+        name := filepath.Join(dir, "input")
+        ioutil.WriteFile(name, []byte("foo"), 0644)
+        key := strings.Repeat("0", 40)
+        if err := c.store(key, []string{ name }, nil); err != nil { t.Fatalf("%v", err) }
+        sum := c.get(key).Outputs[0].Sum
+
+        // Forged results can't write files other than the targets.
+        targets := []string{ "foo.txt", name, "../foo.txt" }
+        for _, s := range []string{ name, "../foo.txt", "bar.txt" } {
+                c.putResult(key, &actionResult{ Outputs:[]*actionOutput{ { Name:s, Sum:sum, Mode:0644 } } })
+                if res, err := c.restore(key, targets); err == nil || res != nil { t.Errorf("%v: restored", s) }
+        }
+        if _, e := os.Stat("bar.txt"); e == nil { os.Remove("bar.txt"); t.Errorf("bar.txt is written") }
+
+        c.putResult(key, &actionResult{ Outputs:[]*actionOutput{ { Name:"foo.txt", Sum:sum, Mode:0644 } } })
+        defer os.Remove("foo.txt")
+        if res, err := c.restore(key, targets); err != nil || res == nil { t.Errorf("not restored: %v", err) }
+        if b, e := ioutil.ReadFile("foo.txt"); e != nil || string(b) != "foo" { t.Errorf("'%s' (%v)", b, e) }
+}
+
+func TestActionCacheArchiveMembers(t *testing.T) {
+        if wd, e := os.Getwd(); e != nil || workdir != wd { t.Errorf("%v != %v (%v)", workdir, wd, e) }
+        if _, err := exec.LookPath("ar"); err != nil { t.Skipf("ar: %v", err) }
+
+        dir, err := ioutil.TempDir("", "smart-cache")
+        if err != nil { t.Fatalf("%v", err) }
+        defer os.RemoveAll(dir)
+        defer SetFlagCache(GetFlagCache())
+        SetFlagCache(dir)
+        os.Remove(databasePath())
+        defer os.Remove(databasePath())
+
+        ctx, err := newTestContext("TestActionCacheArchiveMembers", `
+libfoo.a: libfoo.a(foo.o)
+	@echo $? >> ar.log
+libfoo.a(%.o): %.o
+	@ar rU $@ $% 2>/dev/null
+foo.o:
+`);     if err != nil { t.Errorf("parse error: %v", err) }
+
+        for _, s := range []string{ "foo.o", "libfoo.a", "ar.log" } {
+                os.Remove(s)
+                defer os.Remove(s)
+        }
+        ioutil.WriteFile("foo.o", []byte("foo.o"), 0644)
+
+        // Members are updated in the archive and never cached.
+        stderr := captureStderr(func() { Update(ctx, "libfoo.a") })
+        if stderr != "" { t.Errorf("stderr: %v", stderr) }
+        if fi, e := statFile("libfoo.a(foo.o)"); e != nil { t.Errorf("%v (%v)", fi, e) }
+        if b, e := ioutil.ReadFile("ar.log"); e != nil || string(b) != "foo.o\n" { t.Errorf("'%s' (%v)", b, e) }
+        if s := openCache().loadStats(); s.Stores != 1 { t.Errorf("stats: %+v", s) }
+}
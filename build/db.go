@@ -0,0 +1,234 @@
+//
+//  Copyright (C) 2012-2016, Duzy Chan <code@duzy.info>, all rights reserverd.
+//
+package smart
+
+import (
+        "crypto/sha1"
+        "encoding/hex"
+        "encoding/json"
+        "io"
+        "io/ioutil"
+        "os"
+        "path/filepath"
+        "strings"
+)
+
+// database is the build state kept between runs in `.smart.db` of the top
+// directory, e.g. the commands and prerequisites used to update targets. It's
+// only accessed by the task holding the context.
+type database struct {
+        path string
+        Targets map[string]*targetRecord `json:"targets"`
+        dirty bool
+}
+
+// targetRecord is the state of a target when it's updated last time.
+type targetRecord struct {
+        Command string `json:"command"` // the expanded recipes
+        Prerequisites []string `json:"prerequisites,omitempty"`
+        Vars string `json:"vars,omitempty"` // hash of variables used by recipes
+        Depends []string `json:"depends,omitempty"` // dependencies from the depfile
+        Hash *fileHash `json:"hash,omitempty"`
+        Inputs map[string]*fileHash `json:"inputs,omitempty"`
+}
+
+// fileHash is the content hash of a file, the modification time and size
+// are checked first to avoid hashing unchanged files.
+type fileHash struct {
+        ModTime int64 `json:"mtime"`
+        Size int64 `json:"size"`
+        Sum string `json:"sum"`
+}
+
+// databasePath returns the path of the build database.
+func databasePath() string {
+        return filepath.Join(workdir, ".smart.db")
+}
+
+// loadDatabase loads the build database, a missing or broken database is
+// treated as empty.
+func loadDatabase(path string) (db *database) {
+        db = &database{ path:path }
+        if b, err := ioutil.ReadFile(path); err == nil {
+                if err = json.Unmarshal(b, db); err != nil {
+                        message("ignored broken database '%v' (%v)", path, err)
+                }
+        }
+        if db.Targets == nil {
+                db.Targets = make(map[string]*targetRecord)
+        }
+        return
+}
+
+// save writes the database if it's changed.
+func (db *database) save() (err error) {
+        if db == nil || !db.dirty {
+                return
+        }
+        var b []byte
+        if b, err = json.MarshalIndent(db, "", " "); err != nil {
+                return
+        }
+        if err = os.MkdirAll(filepath.Dir(db.path), 0755); err != nil {
+                return
+        }
+        tmp := db.path + ".tmp"
+        if err = ioutil.WriteFile(tmp, b, 0644); err == nil {
+                err = os.Rename(tmp, db.path)
+        }
+        if err == nil {
+                db.dirty = false
+        }
+        return
+}
+
+// recordKey returns the key of the target record, targets are recorded by
+// absolute paths since modules are updated in their own directories.
+func recordKey(target string) string {
+        if filepath.IsAbs(target) {
+                return target
+        }
+        wd, _ := os.Getwd()
+        return filepath.Join(wd, target)
+}
+
+func (db *database) get(target string) *targetRecord {
+        return db.Targets[recordKey(target)]
+}
+
+// record returns the record of the target to be changed, a new record is
+// created if it's not recorded.
+func (db *database) record(target string) (rec *targetRecord) {
+        key := recordKey(target)
+        if rec = db.Targets[key]; rec == nil {
+                rec = &targetRecord{}
+                db.Targets[key] = rec
+        }
+        db.dirty = true
+        return
+}
+
+// hashFile returns the hash of the file, the previous hash is returned if
+// the modification time and size are not changed.
+func hashFile(name string, prev *fileHash) (h *fileHash, err error) {
+        var fi os.FileInfo
+        if fi, err = os.Stat(name); err != nil {
+                return
+        }
+        mt, size := fi.ModTime().UnixNano(), fi.Size()
+        if prev != nil && prev.ModTime == mt && prev.Size == size {
+                return prev, nil
+        }
+
+        var f *os.File
+        if f, err = os.Open(name); err != nil {
+                return
+        }
+        defer f.Close()
+
+        sum := sha1.New()
+        if _, err = io.Copy(sum, f); err == nil {
+                h = &fileHash{ mt, size, hex.EncodeToString(sum.Sum(nil)) }
+        }
+        return
+}
+
+// checkHashes checks content hashes of the target and prerequisites, it
+// returns the prerequisites changed since the target was updated last time,
+// prerequisites which are not files are not checked. It's not ok if the
+// target is not recorded or changed by others.
+func (db *database) checkHashes(target string, prerequisites []string) (changed []string, ok bool) {
+        rec := db.get(target)
+        if rec == nil || rec.Hash == nil {
+                return
+        }
+        if h, err := hashFile(target, rec.Hash); err != nil || h.Sum != rec.Hash.Sum {
+                return
+        } else if h != rec.Hash {
+                rec.Hash, db.dirty = h, true // touched only
+        }
+        for _, s := range prerequisites {
+                if isDirTarget(s) { continue }
+                prev, _ := rec.Inputs[s]
+                if h, err := hashFile(s, prev); err != nil {
+                        continue // not a file (e.g. phony)
+                } else if prev == nil || h.Sum != prev.Sum {
+                        changed = append(changed, s)
+                } else if h != prev {
+                        rec.Inputs[s], db.dirty = h, true // touched only
+                }
+        }
+        return changed, true
+}
+
+// recordHashes records content hashes of the targets and prerequisites
+// after the targets are updated.
+func (db *database) recordHashes(targets, prerequisites []string) {
+        inputs := make(map[string]*fileHash, len(prerequisites))
+        for _, s := range prerequisites {
+                if isDirTarget(s) { continue }
+                if h, err := hashFile(s, nil); err == nil {
+                        inputs[s] = h
+                }
+        }
+        for _, t := range targets {
+                if isDirTarget(t) { continue }
+                if h, err := hashFile(t, nil); err == nil {
+                        rec := db.record(t)
+                        rec.Hash, rec.Inputs = h, inputs
+                }
+        }
+}
+
+// checkCommand compares the recorded command, prerequisites and variables
+// of the targets with the current ones, it returns the reason if they're
+// changed. Targets not recorded yet are recorded as they're.
+func (db *database) checkCommand(targets, prerequisites []string, command, vars string) (reason string) {
+        for _, t := range targets {
+                if isDirTarget(t) { continue }
+                rec := db.get(t)
+                switch {
+                case rec == nil || rec.Vars == "":
+                        db.recordCommand([]string{ t }, prerequisites, command, vars)
+                case rec.Command != command:
+                        return "command is changed"
+                case strings.Join(rec.Prerequisites, " ") != strings.Join(prerequisites, " "):
+                        return "prerequisites are changed"
+                case rec.Vars != vars:
+                        return "variables are changed"
+                }
+        }
+        return
+}
+
+// recordCommand records the command, prerequisites and variables of the
+// targets after they're updated.
+func (db *database) recordCommand(targets, prerequisites []string, command, vars string) {
+        for _, t := range targets {
+                if isDirTarget(t) { continue }
+                rec := db.record(t)
+                rec.Command, rec.Vars = command, vars
+                rec.Prerequisites = append([]string{}, prerequisites...)
+        }
+}
+
+// depends returns the dependencies of the target recorded from the depfile.
+func (db *database) depends(target string) []string {
+        if rec := db.get(target); rec != nil {
+                return rec.Depends
+        }
+        return nil
+}
+
+// recordDepends records the dependencies of the targets from the depfile.
+func (db *database) recordDepends(targets, depends []string) {
+        for _, t := range targets {
+                if isDirTarget(t) { continue }
+                var list []string
+                for _, s := range depends {
+                        if s != t { list = append(list, s) }
+                }
+                db.record(t).Depends = list
+        }
+}
@@ -0,0 +1,118 @@
+//
+//  Copyright (C) 2012-2016, Duzy Chan <code@duzy.info>, all rights reserverd.
+//
+package smart
+
+import (
+        "os"
+        "fmt"
+        "bytes"
+        "strings"
+        "time"
+        "testing"
+        "io/ioutil"
+)
+
+func TestDatabaseHashes(t *testing.T) {
+        if wd, e := os.Getwd(); e != nil || workdir != wd { t.Errorf("%v != %v (%v)", workdir, wd, e) }
+
+        defer SetFlagHash(GetFlagHash())
+        SetFlagHash(true)
+        os.Remove(databasePath())
+        defer os.Remove(databasePath())
+
+        ctx, err := newTestContext("TestDatabaseHashes", `
+foo.txt: bar.txt
+	@cat $< > $@; echo $? >> foo.log
+bar.txt:
+`);     if err != nil { t.Errorf("parse error: %v", err) }
+
+        os.Remove("foo.txt")
+        os.Remove("foo.log")
+        defer os.Remove("foo.txt")
+        defer os.Remove("foo.log")
+        defer os.Remove("bar.txt")
+
+        check := func(s string) {
+                if b, e := ioutil.ReadFile("foo.log"); e != nil { t.Errorf("%v", e) } else {
+                        if string(b) != s { t.Errorf("'%v' != '%v'", string(b), s) }
+                }
+        }
+
+        ioutil.WriteFile("bar.txt", []byte("bar\n"), 0644)
+        Update(ctx, "foo.txt")
+        check("\n")
+        if _, e := os.Stat(databasePath()); e != nil { t.Errorf("database is not saved: %v", e) }
+
+        // Touched but not changed.
+        future := time.Now().Add(time.Hour)
+        os.Chtimes("bar.txt", future, future)
+        Update(ctx, "foo.txt")
+        check("\n")
+
+        // Changed but older than the target.
+        past := time.Now().Add(-time.Hour)
+        ioutil.WriteFile("bar.txt", []byte("changed\n"), 0644)
+        os.Chtimes("bar.txt", past, past)
+        Update(ctx, "foo.txt")
+        check("\nbar.txt\n")
+        if b, e := ioutil.ReadFile("foo.txt"); e != nil || string(b) != "changed\n" { t.Errorf("'%s' (%v)", b, e) }
+
+        Update(ctx, "foo.txt")
+        check("\nbar.txt\n")
+
+        db := loadDatabase(databasePath())
+        if rec := db.get("foo.txt"); rec == nil || rec.Hash == nil || rec.Inputs["bar.txt"] == nil {
+                t.Errorf("not recorded: %v", rec)
+        }
+}
+
+func TestDatabaseCommands(t *testing.T) {
+        if wd, e := os.Getwd(); e != nil || workdir != wd { t.Errorf("%v != %v (%v)", workdir, wd, e) }
+
+        defer SetFlagDatabase(GetFlagDatabase())
+        SetFlagDatabase(true)
+        os.Remove(databasePath())
+        defer os.Remove(databasePath())
+
+        info, f := new(bytes.Buffer), builtinInfoFunc; defer func(){ builtinInfoFunc = f }()
+        builtinInfoFunc = func(ctx *Context, args Items) {
+                fmt.Fprintf(info, "%v\n", args.Expand(ctx))
+        }
+
+        ctx, err := newTestContext("TestDatabaseCommands", `
+CFLAGS := -O2
+foo.txt: bar.txt
+	@echo $(CFLAGS) $^ > $@ $(info $@)
+bar.txt:
+`);     if err != nil { t.Errorf("parse error: %v", err) }
+
+        os.Remove("foo.txt")
+        defer os.Remove("foo.txt")
+        defer os.Remove("bar.txt")
+        ioutil.WriteFile("bar.txt", []byte("bar\n"), 0644)
+
+        Update(ctx, "foo.txt")
+        if s, x := info.String(), "foo.txt\n"; s != x { t.Errorf("'%v' != '%v'", s, x) }
+
+        // Recipes are expanded quietly to check the command.
+        Update(ctx, "foo.txt")
+        if s, x := info.String(), "foo.txt\n"; s != x { t.Errorf("'%v' != '%v'", s, x) }
+
+        ctx.Set("CFLAGS", stringitem("-O0"))
+        Update(ctx, "foo.txt")
+        if s, x := info.String(), "foo.txt\nfoo.txt\n"; s != x { t.Errorf("'%v' != '%v'", s, x) }
+        if b, e := ioutil.ReadFile("foo.txt"); e != nil || string(b) != "-O0 bar.txt\n" { t.Errorf("'%s' (%v)", b, e) }
+
+        db := loadDatabase(databasePath())
+        rec := db.get("foo.txt")
+        if rec == nil { t.Fatalf("not recorded") }
+        if s, x := rec.Command, "echo -O0 bar.txt > foo.txt "; s != x { t.Errorf("'%v' != '%v'", s, x) }
+        if s, x := strings.Join(rec.Prerequisites, " "), "bar.txt"; s != x { t.Errorf("'%v' != '%v'", s, x) }
+        if rec.Vars == "" { t.Errorf("variables are not recorded") }
+
+        targets := []string{ "foo.txt" }
+        if s, x := db.checkCommand(targets, []string{ "bar.txt" }, rec.Command, rec.Vars), ""; s != x { t.Errorf("'%v' != '%v'", s, x) }
+        if s, x := db.checkCommand(targets, []string{ "bar.txt", "baz.txt" }, rec.Command, rec.Vars), "prerequisites are changed"; s != x { t.Errorf("'%v' != '%v'", s, x) }
+        if s, x := db.checkCommand(targets, []string{ "bar.txt" }, rec.Command, "x"), "variables are changed"; s != x { t.Errorf("'%v' != '%v'", s, x) }
+}
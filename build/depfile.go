@@ -0,0 +1,152 @@
+//
+//  Copyright (C) 2012-2016, Duzy Chan <code@duzy.info>, all rights reserverd.
+//
+package smart
+
+import (
+        "fmt"
+        "io/ioutil"
+        "os"
+        "strings"
+)
+
+// Depfiles are dependencies generated by compilers in Makefile syntax (e.g.
+// `gcc -MMD -MF $@.d`). A depfile is declared by the variable `.DEPFILE` or
+// the module variable `me.depfile`, which is expanded for each target with
+// automatic variables, e.g.
+//
+//      me.depfile = $@.d
+//      %.o: %.c ; gcc -MMD -MF $@.d -c -o $@ $<
+//
+// If the special target `.DEPFILES` is declared, only it's targets have
+// depfiles, e.g. `.DEPFILES: %.o` leaves out the linked targets.
+//
+// The depfile is parsed after the recipe runs and the dependencies are kept
+// in the build database, they're checked as extra prerequisites of the
+// target in the next update.
+
+// getDepfile returns the depfile of the target, automatic variables must be
+// bound before calling it.
+func (r *rule) getDepfile(ctx *Context, target string) (s string) {
+        namespaces := []*namespaceEmbed{ ctx.g }
+        if m := r.module; m != nil {
+                namespaces = append(namespaces, m.namespaceEmbed)
+        }
+        declared, matched := false, false
+        for _, ns := range namespaces {
+                if _, ok := ns.files[".DEPFILES"]; ok {
+                        declared, matched = true, matched || ns.isSpecialTarget(".DEPFILES", target)
+                }
+        }
+        if declared && !matched {
+                return
+        }
+        if m := r.module; m != nil {
+                s = strings.TrimSpace(m.Get(ctx, "depfile"))
+        }
+        if d, ok := ctx.g.defines[".DEPFILE"]; s == "" && ok && d != nil {
+                s = strings.TrimSpace(d.value.Expand(ctx))
+        }
+        return
+}
+
+// hasDepfiles tells if any depfile is declared, the dependencies are kept
+// in the build database.
+func (ctx *Context) hasDepfiles() bool {
+        if d, ok := ctx.g.defines[".DEPFILE"]; ok && d != nil {
+                return true
+        }
+        for _, m := range ctx.modules {
+                if d, ok := m.defines["depfile"]; ok && d != nil {
+                        return true
+                }
+        }
+        return false
+}
+
+// parseDepfile parses the dependencies in Makefile syntax, targets of the
+// rules are not included.
+func parseDepfile(s string) (depends []string, err error) {
+        s = strings.Replace(s, "\\\r\n", " ", -1)
+        s = strings.Replace(s, "\\\n", " ", -1)
+        seen := make(map[string]bool)
+        for _, line := range strings.Split(s, "\n") {
+                if line = strings.TrimRight(line, "\r"); strings.TrimSpace(line) == "" {
+                        continue
+                }
+                i := depfileColon(line)
+                if i < 0 {
+                        return nil, fmt.Errorf("missing ':' in '%v'", line)
+                }
+                for _, w := range splitDepfileWords(line[i+1:]) {
+                        if !seen[w] {
+                                depends, seen[w] = append(depends, w), true
+                        }
+                }
+        }
+        return
+}
+
+// depfileColon returns the position of the colon separating targets and
+// dependencies, a colon followed by other characters is a part of the name
+// (e.g. `C:\foo.h`).
+func depfileColon(line string) int {
+        for i := 0; i < len(line); i++ {
+                switch line[i] {
+                case '\\': i++
+                case ':':
+                        if i+1 == len(line) || line[i+1] == ' ' || line[i+1] == '\t' {
+                                return i
+                        }
+                }
+        }
+        return -1
+}
+
+// splitDepfileWords splits the names separated by spaces, escaped spaces
+// (`\ `), `\#` and `$$` are unescaped.
+func splitDepfileWords(s string) (words []string) {
+        var word []byte
+        for i := 0; i < len(s); i++ {
+                switch c := s[i]; {
+                case c == '\\' && i+1 < len(s) && (s[i+1] == ' ' || s[i+1] == '#'):
+                        i++
+                        word = append(word, s[i])
+                case c == '$' && i+1 < len(s) && s[i+1] == '$':
+                        i++
+                        word = append(word, '$')
+                case c == ' ' || c == '\t':
+                        if 0 < len(word) {
+                                words, word = append(words, string(word)), nil
+                        }
+                default:
+                        word = append(word, c)
+                }
+        }
+        if 0 < len(word) {
+                words = append(words, string(word))
+        }
+        return
+}
+
+// readDepfile reads the dependencies in the depfile.
+func readDepfile(name string) (depends []string, err error) {
+        var b []byte
+        if b, err = ioutil.ReadFile(name); err == nil {
+                depends, err = parseDepfile(string(b))
+        }
+        return
+}
+
+// checkDepends checks the dependencies with the target by modification
+// time, it returns the reason if the target needs update.
+func checkDepends(depends []string, ti os.FileInfo) string {
+        for _, s := range depends {
+                if fi, err := os.Stat(s); err != nil {
+                        return fmt.Sprintf("dependency '%v' is missing", s)
+                } else if ti != nil && fi.ModTime().After(ti.ModTime()) {
+                        return fmt.Sprintf("dependency '%v' is newer", s)
+                }
+        }
+        return ""
+}
@@ -0,0 +1,92 @@
+//
+//  Copyright (C) 2012-2016, Duzy Chan <code@duzy.info>, all rights reserverd.
+//
+package smart
+
+import (
+        "os"
+        "strings"
+        "time"
+        "testing"
+        "io/ioutil"
+)
+
+func TestParseDepfile(t *testing.T) {
+        for _, c := range []struct{ s, depends string }{
+                { "", "" },
+                { "foo.o: foo.c foo.h\n", "foo.c foo.h" },
+                { "foo.o: foo.c \\\n  foo.h \\\n  bar.h\n", "foo.c foo.h bar.h" },
+                { "foo.o: foo.c \\\r\n  foo.h\r\n", "foo.c foo.h" },
+                { "foo.o: foo.c foo.h\nfoo.h:\n", "foo.c foo.h" }, // -MP
+                { "foo.o foo.d: a\\ b.h c$$.h d\\#.h\n", "a b.h|c$.h|d#.h" },
+                { "C:\\foo.o: C:\\foo.c\n", "C:\\foo.c" },
+        } {
+                depends, err := parseDepfile(c.s)
+                if err != nil { t.Errorf("%v: %v", c.s, err) }
+                sep := " "
+                if strings.Contains(c.depends, "|") { sep = "|" }
+                if s := strings.Join(depends, sep); s != c.depends { t.Errorf("%v: '%v' != '%v'", c.s, s, c.depends) }
+        }
+        if _, err := parseDepfile("foo.o foo.c\n"); err == nil { t.Errorf("missing ':' is not reported") }
+}
+
+func TestDepfile(t *testing.T) {
+        if wd, e := os.Getwd(); e != nil || workdir != wd { t.Errorf("%v != %v (%v)", workdir, wd, e) }
+
+        os.Remove(databasePath())
+        defer os.Remove(databasePath())
+
+        ctx, err := newTestContext("TestDepfile", `
+.DEPFILE = $@.d
+foo.o: foo.c
+	@cat $< foo.h > $@; echo "$@: $< foo.h" > $@.d
+foo.c:
+`);     if err != nil { t.Errorf("parse error: %v", err) }
+
+        for _, s := range []string{ "foo.o", "foo.o.d", "foo.c", "foo.h" } {
+                defer os.Remove(s)
+        }
+        past := time.Now().Add(-time.Hour)
+        ioutil.WriteFile("foo.c", []byte("c\n"), 0644)
+        ioutil.WriteFile("foo.h", []byte("h1\n"), 0644)
+        os.Chtimes("foo.c", past, past)
+        os.Chtimes("foo.h", past, past)
+
+        Update(ctx, "foo.o")
+        if b, e := ioutil.ReadFile("foo.o"); e != nil || string(b) != "c\nh1\n" { t.Errorf("'%s' (%v)", b, e) }
+        if s, x := strings.Join(loadDatabase(databasePath()).depends("foo.o"), " "), "foo.c foo.h"; s != x { t.Errorf("'%v' != '%v'", s, x) }
+
+        // The header is not a prerequisite, but it's recorded from the depfile.
+        ioutil.WriteFile("foo.h", []byte("h2\n"), 0644)
+        future := time.Now().Add(time.Hour)
+        os.Chtimes("foo.h", future, future)
+        Update(ctx, "foo.o")
+        if b, e := ioutil.ReadFile("foo.o"); e != nil || string(b) != "c\nh2\n" { t.Errorf("'%s' (%v)", b, e) }
+}
+
+func TestDepfileTargets(t *testing.T) {
+        ctx, err := newTestContext("TestDepfileTargets", `
+.DEPFILE = $@.d
+.DEPFILES: %.o
+foo: foo.o
+foo.o:
+
+module bar
+me.depfile = $@.d
+.DEPFILES: %.o
+bar: bar.o
+bar.o:
+commit
+`);     if err != nil { t.Errorf("parse error: %v", err) }
+
+        bar := ctx.modules["bar"]
+        if bar == nil { t.Fatalf("no module 'bar'") }
+        for _, c := range []struct{ r *rule; target string; depfile bool }{
+                { ctx.g.files["foo"], "foo", false },
+                { ctx.g.files["foo.o"], "foo.o", true },
+                { bar.files["bar"], "bar", false },
+                { bar.files["bar.o"], "bar.o", true },
+        } {
+                if s := c.r.getDepfile(ctx, c.target); (s != "") != c.depfile { t.Errorf("%v: depfile '%v'", c.target, s) }
+        }
+}
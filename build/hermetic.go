@@ -0,0 +1,155 @@
+//
+//  Copyright (C) 2012-2016, Duzy Chan <code@duzy.info>, all rights reserverd.
+//
+package smart
+
+import (
+        "errors"
+        "fmt"
+        "os"
+        "path/filepath"
+        "sort"
+        "strings"
+)
+
+// In hermetic mode (`-hermetic`), files in the working directory and the
+// directories of targets are snapshotted before and after each recipe, files
+// written but not declared as targets (or the depfile) are reported, and so
+// are targets not updated by the recipe. Violations are errors if `-strict`
+// is set. Recipes are run one by one in hermetic mode, since writes of other
+// recipes can't be told apart.
+
+// fileState is the state of a file in a snapshot.
+type fileState struct {
+        mtime, size int64
+}
+
+// snapshot is the states of files by absolute paths.
+type snapshot map[string]fileState
+
+var errHermetic = errors.New("undeclared writes or targets not updated")
+
+// takeSnapshot walks the directories recursively, directories like `.git`
+// are skipped as traversing does.
+func takeSnapshot(roots []string) snapshot {
+        ss := make(snapshot)
+        for _, root := range roots {
+                filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+                        if err != nil {
+                                return nil
+                        }
+                        if fi.IsDir() {
+                                if path != root && *flagGG && matchFileInfo(fi, generalMetaFiles) != nil {
+                                        return filepath.SkipDir
+                                }
+                                return nil
+                        }
+                        ss[path] = fileState{ fi.ModTime().UnixNano(), fi.Size() }
+                        return nil
+                })
+        }
+        return ss
+}
+
+// hermeticRoots returns the directories to snapshot for the job, nested
+// ones are dropped.
+func (job *executeRecipes) hermeticRoots(targets []string) (roots []string) {
+        dirs := []string{ job.dir }
+        for _, t := range targets {
+                dirs = append(dirs, filepath.Dir(job.abs(t)))
+        }
+        sort.Strings(dirs)
+        for _, d := range dirs {
+                if n := len(roots); 0 < n && isSubpath(roots[n-1], d) {
+                        continue
+                }
+                roots = append(roots, d)
+        }
+        return
+}
+
+// abs returns the absolute path of the name in the working directory.
+func (job *executeRecipes) abs(name string) string {
+        if !filepath.IsAbs(name) {
+                name = filepath.Join(job.dir, name)
+        }
+        return filepath.Clean(name)
+}
+
+// isSubpath tells if the path is the directory or underneath it.
+func isSubpath(dir, path string) bool {
+        return path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, string(filepath.Separator)) + string(filepath.Separator))
+}
+
+// checkHermetic compares the snapshots taken before and after the recipes,
+// it returns the number of violations reported.
+func (r *rule) checkHermetic(job *executeRecipes, before, after snapshot, targets []string, depfile string) (violations int) {
+        s, lineno, colno := r.getLocation()
+        level := "warning"
+        if *flagStrict {
+                level = "error"
+        }
+        report := func(f string, a ...interface{}) {
+                fmt.Fprintf(os.Stderr, "%v:%v:%v:%v: %v\n", s, lineno, colno, level, fmt.Sprintf(f, a...))
+                violations++
+        }
+
+        // Archive members are written to the archives.
+        var files []string
+        for _, t := range targets {
+                if archive, _, ok := splitArchiveMember(t); ok { t = archive }
+                files = append(files, t)
+        }
+        targets = files
+
+        declared := func(path string) bool {
+                if path == databasePath() || (depfile != "" && path == job.abs(depfile)) {
+                        return true
+                }
+                for _, t := range targets {
+                        if (isDirTarget(t) && isSubpath(job.abs(t), path)) || path == job.abs(t) {
+                                return true
+                        }
+                }
+                return false
+        }
+
+        var changed, removed []string
+        for path, st := range after {
+                if prev, ok := before[path]; (!ok || prev != st) && !declared(path) {
+                        changed = append(changed, path)
+                }
+        }
+        for path := range before {
+                if _, ok := after[path]; !ok && !declared(path) {
+                        removed = append(removed, path)
+                }
+        }
+        sort.Strings(changed)
+        sort.Strings(removed)
+        for _, path := range changed {
+                report("'%v' is written but not declared by '%v'", job.rel(path), job.target)
+        }
+        for _, path := range removed {
+                report("'%v' is removed but not declared by '%v'", job.rel(path), job.target)
+        }
+
+        for _, t := range targets {
+                if isDirTarget(t) { continue }
+                path := job.abs(t)
+                if st, ok := after[path]; !ok {
+                        report("target '%v' is not created by the recipe", t)
+                } else if prev, ok := before[path]; ok && prev == st {
+                        report("target '%v' is not updated by the recipe", t)
+                }
+        }
+        return
+}
+
+// rel returns the path relative to the working directory if it's underneath.
+func (job *executeRecipes) rel(path string) string {
+        if s, err := filepath.Rel(job.dir, path); err == nil && !strings.HasPrefix(s, "..") {
+                return s
+        }
+        return path
+}
@@ -0,0 +1,85 @@
+//
+//  Copyright (C) 2012-2016, Duzy Chan <code@duzy.info>, all rights reserverd.
+//
+package smart
+
+import (
+        "os"
+        "strings"
+        "testing"
+)
+
+func TestHermetic(t *testing.T) {
+        if wd, e := os.Getwd(); e != nil || workdir != wd { t.Errorf("%v != %v (%v)", workdir, wd, e) }
+
+        defer SetFlagHermetic(GetFlagHermetic())
+        defer SetFlagStrict(GetFlagStrict())
+        SetFlagHermetic(true)
+
+        ctx, err := newTestContext("TestHermetic", `
+good.txt:
+	@echo good > $@; echo $@ > $@.d
+bad.txt:
+	@echo bad > $@; echo leak > leak.txt
+lazy.txt:
+	@true
+out/:
+	@mkdir -p $@ && touch $@/a.txt
+.DEPFILE = $@.d
+.DELETE_ON_ERROR:
+`);     if err != nil { t.Errorf("parse error: %v", err) }
+
+        for _, s := range []string{ "good.txt", "good.txt.d", "bad.txt", "bad.txt.d", "leak.txt", "lazy.txt" } {
+                os.Remove(s)
+                defer os.Remove(s)
+        }
+        os.RemoveAll("out")
+        defer os.RemoveAll("out")
+
+        for _, c := range []struct{ target string; warnings []string }{
+                { "good.txt", nil },
+                { "out/", nil },
+                { "bad.txt", []string{ "TestHermetic:4:1:warning: 'leak.txt' is written but not declared by 'bad.txt'" } },
+                { "lazy.txt", []string{ "TestHermetic:6:1:warning: target 'lazy.txt' is not created by the recipe" } },
+        } {
+                s := captureStderr(func() { Update(ctx, c.target) })
+                for _, w := range c.warnings {
+                        if !strings.Contains(s, w) { t.Errorf("%v: missing '%v' in '%v'", c.target, w, s) }
+                }
+                if n := strings.Count(s, "warning:"); n != len(c.warnings) { t.Errorf("%v: %v warnings: '%v'", c.target, n, s) }
+        }
+
+        // Violations are errors in strict mode.
+        SetFlagStrict(true)
+        os.Remove("bad.txt")
+        s := captureStderr(func() { Update(ctx, "bad.txt") })
+        if !strings.Contains(s, "TestHermetic:4:1:error: 'leak.txt' is written") { t.Errorf("'%v'", s) }
+        if !strings.Contains(s, "recipe for 'bad.txt' failed") { t.Errorf("'%v'", s) }
+        if _, e := os.Stat("bad.txt"); e == nil { t.Errorf("bad.txt is not deleted") }
+}
+
+func TestHermeticPhony(t *testing.T) {
+        if wd, e := os.Getwd(); e != nil || workdir != wd { t.Errorf("%v != %v (%v)", workdir, wd, e) }
+
+        defer SetFlagHermetic(GetFlagHermetic())
+        defer SetFlagJ(GetFlagJ())
+        SetFlagHermetic(true)
+        SetFlagJ(2)
+
+        ctx, err := newTestContext("TestHermeticPhony", `
+all:!: noise slow.txt
+noise:!:
+	@sleep 0.1; touch noise.txt
+slow.txt:
+	@sleep 0.3; touch $@
+`);     if err != nil { t.Errorf("parse error: %v", err) }
+
+        os.Remove("noise.txt")
+        os.Remove("slow.txt")
+        defer os.Remove("noise.txt")
+        defer os.Remove("slow.txt")
+
+        // Writes of phony recipes are not seen by others.
+        if s := captureStderr(func() { Update(ctx, "all") }); s != "" { t.Errorf("'%v'", s) }
+        if _, e := os.Stat("noise.txt"); e != nil { t.Errorf("%v", e) }
+}
@@ -0,0 +1,330 @@
+//
+//  Copyright (C) 2012-2016, Duzy Chan <code@duzy.info>, all rights reserverd.
+//
+package smart
+
+import (
+        "fmt"
+        "io/ioutil"
+        "os"
+        "os/exec"
+        "path/filepath"
+        "strconv"
+        "strings"
+        "sync"
+        "syscall"
+)
+
+// The GNU make jobserver protocol shares one job budget (-j) between make
+// processes. The server writes a token (one byte) for each job slot except
+// the first one into a pipe or a fifo, a process has to read a token before
+// running an extra job and write it back when the job is done. The pipe or
+// fifo is passed in MAKEFLAGS to recursive recipes (with the `+` prefix)
+// and delegated commands (Excmd), like GNU make, e.g.
+//
+//      MAKEFLAGS=" -j8 --jobserver-auth=3,4"
+//      MAKEFLAGS=" -j8 --jobserver-auth=fifo:/tmp/GMfifo1234"
+//
+// smart is the server for it's children, or a client if it's started by make
+// (or smart) with a jobserver.
+
+const (
+        jobserverStylePipe = "pipe"
+        jobserverStyleFifo = "fifo"
+)
+
+// implicitToken is the free job slot every process has without a token.
+const implicitToken = -1
+
+// jobs is the jobserver of the current update.
+var jobs *jobserver
+
+type jobserver struct {
+        r, w *os.File // nil if no more job slots (-j1)
+        fifo string // the fifo path of the fifo style
+        size int // the job number passed to children, 0 for clients
+        owner bool // the pipe or fifo is created by this process
+        free chan bool // holds the implicit job slot
+
+        mu sync.Mutex // guards the fields below
+        reader sync.Once // starts the goroutine reading tokens
+        want chan bool // asks the reader to read a token
+        reading, broken bool
+        waiters []chan int // acquire calls waiting for tokens
+}
+
+// makeJobserver is the jobserver of make running smart, it's joined once
+// since the inherited descriptors must be kept open.
+var makeJobserver struct {
+        sync.Once
+        js *jobserver
+}
+
+// startJobserver joins the jobserver of make running smart, or creates one
+// for n jobs.
+func startJobserver(n int, style string) (js *jobserver, err error) {
+        makeJobserver.Do(func() {
+                makeJobserver.js, err = joinJobserver(os.Getenv("MAKEFLAGS"))
+                if err != nil {
+                        fmt.Fprintf(os.Stderr, "smart: jobserver unavailable (%v), using -j1\n", err)
+                        makeJobserver.js, err = newJobserver(1, style)
+                }
+        })
+        if js = makeJobserver.js; js != nil {
+                js.free = make(chan bool, 1)
+                js.free <- true
+                return
+        }
+        return newJobserver(n, style)
+}
+
+// parseJobserverAuth finds the jobserver in MAKEFLAGS, it's either the
+// descriptors `R,W` or the fifo `fifo:PATH`.
+func parseJobserverAuth(makeflags string) (auth string) {
+        for _, s := range strings.Fields(makeflags) {
+                switch {
+                case strings.HasPrefix(s, "--jobserver-auth="):
+                        auth = strings.TrimPrefix(s, "--jobserver-auth=")
+                case strings.HasPrefix(s, "--jobserver-fds="):
+                        auth = strings.TrimPrefix(s, "--jobserver-fds=")
+                }
+        }
+        return
+}
+
+// joinJobserver joins the jobserver in MAKEFLAGS as a client, it returns
+// nil if there's none.
+func joinJobserver(makeflags string) (js *jobserver, err error) {
+        auth := parseJobserverAuth(makeflags)
+        if auth == "" {
+                return
+        }
+
+        js = &jobserver{}
+        if strings.HasPrefix(auth, "fifo:") {
+                js.fifo = strings.TrimPrefix(auth, "fifo:")
+                if js.r, err = os.OpenFile(js.fifo, os.O_RDWR, 0); err != nil {
+                        return nil, err
+                }
+                js.w = js.r
+                return
+        }
+
+        fds := strings.Split(auth, ",")
+        if len(fds) != 2 {
+                return nil, fmt.Errorf("bad jobserver '%v'", auth)
+        }
+        var files [2]*os.File
+        for i, s := range fds {
+                fd, e := strconv.Atoi(s)
+                if e != nil || fd < 0 {
+                        return nil, fmt.Errorf("bad jobserver '%v'", auth)
+                }
+                // The descriptors are closed if the recipe running smart is not
+                // marked as a recursive make (with '+' or $(MAKE)).
+                var st syscall.Stat_t
+                if e = syscall.Fstat(fd, &st); e != nil {
+                        return nil, fmt.Errorf("jobserver '%v': %v", auth, e)
+                } else if st.Mode&syscall.S_IFMT != syscall.S_IFIFO {
+                        return nil, fmt.Errorf("jobserver '%v': not a pipe", auth)
+                }
+                files[i] = os.NewFile(uintptr(fd), fmt.Sprintf("jobserver-%d", fd))
+        }
+        js.r, js.w = files[0], files[1]
+        return
+}
+
+// newJobserver creates a jobserver for n jobs.
+func newJobserver(n int, style string) (js *jobserver, err error) {
+        js = &jobserver{ size:n, owner:true, free:make(chan bool, 1) }
+        js.free <- true
+        if n <= 1 {
+                return
+        }
+
+        switch style {
+        case jobserverStylePipe, "":
+                if js.r, js.w, err = os.Pipe(); err != nil {
+                        return nil, err
+                }
+        case jobserverStyleFifo:
+                var d string
+                if d, err = ioutil.TempDir("", "smart"); err != nil {
+                        return nil, err
+                }
+                js.fifo = filepath.Join(d, "jobserver")
+                if err = syscall.Mkfifo(js.fifo, 0600); err != nil {
+                        os.RemoveAll(d)
+                        return nil, err
+                }
+                if js.r, err = os.OpenFile(js.fifo, os.O_RDWR, 0); err != nil {
+                        os.RemoveAll(d)
+                        return nil, err
+                }
+                js.w = js.r
+        default:
+                return nil, fmt.Errorf("unknown jobserver style '%v'", style)
+        }
+
+        if _, err = js.w.Write([]byte(strings.Repeat("+", n-1))); err != nil {
+                js.close()
+                return nil, err
+        }
+        return
+}
+
+// serial tells if only the implicit job slot is available.
+func (js *jobserver) serial() bool {
+        return js == nil || js.r == nil
+}
+
+// acquire takes a job slot, the implicit slot is preferred. It returns the
+// token read from the jobserver, or implicitToken.
+func (js *jobserver) acquire() int {
+        select {
+        case <-js.free: return implicitToken
+        default:
+        }
+        if js.serial() {
+                <-js.free
+                return implicitToken
+        }
+
+        got := make(chan int, 1)
+        js.reader.Do(func() {
+                js.want = make(chan bool, 1)
+                go js.readTokens()
+        })
+        js.mu.Lock()
+        if js.broken {
+                js.mu.Unlock()
+                <-js.free
+                return implicitToken
+        }
+        js.waiters = append(js.waiters, got)
+        if !js.reading {
+                js.reading = true
+                js.want <- true
+        }
+        js.mu.Unlock()
+
+        select {
+        case <-js.free:
+                // The token is not needed any more, it's given back if
+                // it's already passed to this call.
+                js.mu.Lock()
+                for i, w := range js.waiters {
+                        if w == got {
+                                js.waiters = append(js.waiters[:i], js.waiters[i+1:]...)
+                                break
+                        }
+                }
+                js.mu.Unlock()
+                select {
+                case t, ok := <-got:
+                        if ok { js.release(t) }
+                default:
+                }
+                return implicitToken
+        case t, ok := <-got:
+                if !ok {
+                        <-js.free
+                        return implicitToken
+                }
+                return t
+        }
+}
+
+// readTokens reads tokens for the waiting acquire calls, one at a time, so
+// that only this goroutine is blocked in reading. A token nobody waits for
+// is written back.
+func (js *jobserver) readTokens() {
+        b := make([]byte, 1)
+        for range js.want {
+                n, err := js.r.Read(b)
+                js.mu.Lock()
+                js.reading = false
+                if n != 1 || err != nil {
+                        js.broken = true
+                        for _, w := range js.waiters {
+                                close(w)
+                        }
+                        js.waiters = nil
+                        js.mu.Unlock()
+                        return
+                }
+                if 0 < len(js.waiters) {
+                        js.waiters[0] <- int(b[0])
+                        js.waiters = js.waiters[1:]
+                } else {
+                        js.w.Write(b)
+                }
+                if 0 < len(js.waiters) {
+                        js.reading = true
+                        js.want <- true
+                }
+                js.mu.Unlock()
+        }
+}
+
+// release gives back the job slot taken by acquire.
+func (js *jobserver) release(t int) {
+        if t == implicitToken {
+                js.free <- true
+        } else {
+                js.w.Write([]byte{ byte(t) })
+        }
+}
+
+// makeflags returns MAKEFLAGS passed to children, the jobserver descriptors
+// of the pipe style are always 3 and 4 (see setup).
+func (js *jobserver) makeflags(makeflags string) string {
+        var flags []string
+        for _, s := range strings.Fields(makeflags) {
+                if strings.HasPrefix(s, "--jobserver-auth=") || strings.HasPrefix(s, "--jobserver-fds=") {
+                        continue
+                }
+                if js.owner && strings.HasPrefix(s, "-j") {
+                        continue
+                }
+                flags = append(flags, s)
+        }
+        if js.owner {
+                flags = append(flags, fmt.Sprintf("-j%d", js.size))
+        }
+        if js.fifo != "" {
+                flags = append(flags, "--jobserver-auth=fifo:" + js.fifo)
+        } else {
+                flags = append(flags, "--jobserver-auth=3,4")
+        }
+        return " " + strings.Join(flags, " ")
+}
+
+// setup passes the jobserver to the command of a recursive recipe or a
+// delegated command.
+func (js *jobserver) setup(cmd *exec.Cmd) {
+        if js.serial() {
+                return
+        }
+        if cmd.Env == nil {
+                cmd.Env = os.Environ()
+        }
+        cmd.Env = append(cmd.Env, "MAKEFLAGS=" + js.makeflags(os.Getenv("MAKEFLAGS")))
+        if js.fifo == "" {
+                cmd.ExtraFiles = []*os.File{ js.r, js.w }
+        }
+}
+
+// close closes the jobserver created by this process.
+func (js *jobserver) close() {
+        if js == nil || !js.owner || js.r == nil {
+                return
+        }
+        js.r.Close()
+        if js.w != js.r {
+                js.w.Close()
+        }
+        if js.fifo != "" {
+                os.RemoveAll(filepath.Dir(js.fifo))
+        }
+}
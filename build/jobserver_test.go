@@ -0,0 +1,155 @@
+//
+//  Copyright (C) 2012-2016, Duzy Chan <code@duzy.info>, all rights reserverd.
+//
+package smart
+
+import (
+        "os"
+        "runtime"
+        "strings"
+        "time"
+        "testing"
+        "io/ioutil"
+)
+
+func TestJobserverAuth(t *testing.T) {
+        for _, c := range []struct{ s, auth string }{
+                { "", "" },
+                { "k -j8", "" },
+                { " -j8 --jobserver-auth=3,4", "3,4" },
+                { "--jobserver-fds=5,6 -j", "5,6" },
+                { " -j8 --jobserver-auth=fifo:/tmp/GMfifo1", "fifo:/tmp/GMfifo1" },
+        } {
+                if s := parseJobserverAuth(c.s); s != c.auth { t.Errorf("%v: '%v' != '%v'", c.s, s, c.auth) }
+        }
+
+        js := &jobserver{ size:3, owner:true, r:os.Stdin, w:os.Stdout }
+        if s, x := js.makeflags("k -j8 --jobserver-auth=5,6"), " k -j3 --jobserver-auth=3,4"; s != x { t.Errorf("'%v' != '%v'", s, x) }
+        js = &jobserver{ fifo:"/tmp/f", r:os.Stdin, w:os.Stdin }
+        if s, x := js.makeflags("k -j8 --jobserver-auth=fifo:/tmp/f"), " k -j8 --jobserver-auth=fifo:/tmp/f"; s != x { t.Errorf("'%v' != '%v'", s, x) }
+}
+
+func testJobserverTokens(t *testing.T, js *jobserver, n int) {
+        var tokens []int
+        for i := 0; i < n; i++ {
+                tokens = append(tokens, js.acquire())
+        }
+        if tokens[0] != implicitToken { t.Errorf("implicit slot is not taken first: %v", tokens) }
+        for _, tok := range tokens[1:] {
+                if tok != '+' { t.Errorf("bad token: %v", tokens) }
+        }
+
+        got := make(chan int, 1)
+        go func() { got <- js.acquire() }()
+        select {
+        case tok := <-got: t.Errorf("too many slots: %v", tok)
+        case <-time.After(100*time.Millisecond):
+        }
+        js.release(tokens[0])
+        if tok := <-got; tok != implicitToken { t.Errorf("released slot is not taken: %v", tok) }
+        js.release(implicitToken)
+        for _, tok := range tokens[1:] {
+                js.release(tok)
+        }
+}
+
+func TestJobserverPipe(t *testing.T) {
+        js, err := newJobserver(3, "pipe")
+        if err != nil { t.Fatalf("%v", err) }
+        defer js.close()
+        testJobserverTokens(t, js, 3)
+}
+
+func TestJobserverFifo(t *testing.T) {
+        js, err := newJobserver(3, "fifo")
+        if err != nil { t.Fatalf("%v", err) }
+        defer js.close()
+        if _, err := os.Stat(js.fifo); err != nil { t.Errorf("%v", err) }
+
+        c, err := joinJobserver(js.makeflags(""))
+        if err != nil { t.Fatalf("%v", err) }
+        if c == nil || c.fifo != js.fifo { t.Fatalf("jobserver not joined: %v", c) }
+        defer c.r.Close()
+        c.free = make(chan bool, 1)
+        c.free <- true
+        testJobserverTokens(t, c, 3)
+
+        d := js.fifo
+        js.close()
+        if _, err := os.Stat(d); err == nil { t.Errorf("fifo is not removed") }
+}
+
+func TestJobserverChildren(t *testing.T) {
+        if wd, e := os.Getwd(); e != nil || workdir != wd { t.Errorf("%v != %v (%v)", workdir, wd, e) }
+
+        defer SetFlagJ(GetFlagJ())
+        SetFlagJ(4)
+
+        ctx, err := newTestContext("TestJobserverChildren", `
+foo.txt:
+	+@echo "$$MAKEFLAGS" > $@
+	+@head -c1 <&3 >&4
+bar.txt:
+	@echo "$$MAKEFLAGS" > $@
+	@if (true <&3) 2>/dev/null; then echo leaked >> $@; fi
+`);     if err != nil { t.Errorf("parse error: %v", err) }
+
+        os.Remove("foo.txt")
+        os.Remove("bar.txt")
+        defer os.Remove("foo.txt")
+        defer os.Remove("bar.txt")
+        Update(ctx, "foo.txt", "bar.txt")
+        if b, e := ioutil.ReadFile("foo.txt"); e != nil { t.Errorf("%v", e) } else {
+                if s := string(b); !strings.Contains(s, "-j4 --jobserver-auth=3,4") { t.Errorf("MAKEFLAGS: '%v'", s) }
+        }
+
+        // Only recursive recipes (with '+') get the jobserver.
+        if b, e := ioutil.ReadFile("bar.txt"); e != nil { t.Errorf("%v", e) } else {
+                if s := string(b); strings.Contains(s, "jobserver") || strings.Contains(s, "leaked") { t.Errorf("bar.txt: '%v'", s) }
+        }
+}
+
+func TestJobserverExcmd(t *testing.T) {
+        js, err := newJobserver(4, "pipe")
+        if err != nil { t.Fatalf("%v", err) }
+        defer js.close()
+
+        saved := jobs
+        defer func() { jobs = saved }()
+        jobs = js
+
+        c := NewExcmd("sh")
+        if !c.Run("", "-c", `echo "$MAKEFLAGS"; head -c1 <&3 >&4`) { t.Errorf("failed: %v", c.GetStderr()) }
+        if s := c.GetStdout().String(); !strings.Contains(s, "-j4 --jobserver-auth=3,4") { t.Errorf("MAKEFLAGS: '%v'", s) }
+
+        // The job slot is given back.
+        a, b := js.acquire(), js.acquire()
+        if a != implicitToken || b == implicitToken { t.Errorf("slots: %v %v", a, b) }
+        js.release(a)
+        js.release(b)
+}
+
+func TestJobserverReader(t *testing.T) {
+        js, err := newJobserver(2, "pipe")
+        if err != nil { t.Fatalf("%v", err) }
+        defer js.close()
+
+        a, b := js.acquire(), js.acquire()
+        n := runtime.NumGoroutine()
+        for i := 0; i < 10; i++ {
+                got := make(chan int, 1)
+                go func() { got <- js.acquire() }()
+                time.Sleep(10*time.Millisecond)
+                js.release(a)
+                if a = <-got; a != implicitToken { t.Errorf("released slot is not taken: %v", a) }
+        }
+
+        // Contended reads are not left behind.
+        time.Sleep(10*time.Millisecond)
+        if d := runtime.NumGoroutine() - n; 1 < d { t.Errorf("%v goroutines are left", d) }
+        js.release(b)
+        c := js.acquire()
+        if c != '+' { t.Errorf("token is not given back: %v", c) }
+        js.release(c)
+        js.release(a)
+}
@@ -0,0 +1,141 @@
+//
+//  Copyright (C) 2012-2016, Duzy Chan <code@duzy.info>, all rights reserverd.
+//
+package smart
+
+import (
+        "bytes"
+        "fmt"
+        "io"
+        "os"
+        "strings"
+        "sync"
+)
+
+// Output synchronization modes (--output-sync), like GNU make.
+const (
+        outputSyncNone = "none" // outputs are written directly
+        outputSyncLine = "line" // each line of outputs is written as a whole
+        outputSyncTarget = "target" // outputs of a target are written together
+        outputSyncRecurse = "recurse" // outputs of a module are written together
+)
+
+var (
+        outputLock sync.Mutex // serializes outputs of jobs
+
+        // The writers receiving outputs of jobs, they're replaced by tests.
+        jobStdout io.Writer = os.Stdout
+        jobStderr io.Writer = os.Stderr
+)
+
+// dumpOutput writes outputs in a block with the header.
+func dumpOutput(w io.Writer, header, so, se string) {
+        if header != "" {
+                fmt.Fprintf(w, "--------------------------------------------------------------------------------\n")
+                fmt.Fprintf(w, "%v\n", header)
+        }
+        if so != "" {
+                fmt.Fprintf(w, "------------------------------------------------------------------------- stdout\n")
+                fmt.Fprintf(w, "%v", so)
+                if !strings.HasSuffix(so, "\n") { fmt.Fprintf(w, "\n") }
+        }
+        if se != "" {
+                fmt.Fprintf(w, "------------------------------------------------------------------------- stderr\n")
+                fmt.Fprintf(w, "%v", se)
+                if !strings.HasSuffix(se, "\n") { fmt.Fprintf(w, "\n") }
+        }
+        fmt.Fprintf(w, "--------------------------------------------------------------------------------\n")
+}
+
+// lineWriter writes complete lines to w, a partial line is kept until it's
+// completed or flushed.
+type lineWriter struct {
+        w io.Writer
+        buf []byte
+}
+
+func (lw *lineWriter) Write(p []byte) (n int, err error) {
+        lw.buf = append(lw.buf, p...)
+        if i := bytes.LastIndexByte(lw.buf, '\n'); 0 <= i {
+                outputLock.Lock()
+                _, err = lw.w.Write(lw.buf[:i+1])
+                outputLock.Unlock()
+                lw.buf = lw.buf[i+1:]
+        }
+        return len(p), err
+}
+
+func (lw *lineWriter) flush() {
+        if 0 < len(lw.buf) {
+                outputLock.Lock()
+                lw.w.Write(append(lw.buf, '\n'))
+                outputLock.Unlock()
+                lw.buf = nil
+        }
+}
+
+// jobOutput holds the writers of a job according to the output sync mode.
+type jobOutput struct {
+        header string
+        stdout, stderr io.Writer // writers used by the job
+        so, se *bytes.Buffer // buffered outputs in target and recurse modes
+        module *bytes.Buffer // outputs of the module in recurse mode
+}
+
+// newJobOutput creates the output of the job updating target by the rule.
+func newJobOutput(ctx *Context, r *rule, target string) (out *jobOutput) {
+        s, lineno, _ := r.getLocation()
+        out = &jobOutput{
+                header: fmt.Sprintf("%v:%v: %v", s, lineno, target),
+                stdout: jobStdout, stderr: jobStderr,
+        }
+        switch mode := *flagOutputSync; mode {
+        case outputSyncNone, "":
+        case outputSyncLine:
+                out.stdout = &lineWriter{ w:jobStdout }
+                out.stderr = &lineWriter{ w:jobStderr }
+        case outputSyncRecurse:
+                if m := ctx.m; m != nil && m.Updating {
+                        if out.module = ctx.outputs[m]; out.module == nil {
+                                out.module = new(bytes.Buffer)
+                                ctx.outputs[m] = out.module
+                        }
+                }
+                fallthrough
+        case outputSyncTarget:
+                out.so, out.se = new(bytes.Buffer), new(bytes.Buffer)
+                out.stdout, out.stderr = out.so, out.se
+        default:
+                errorf("unknown output sync mode '%v'", mode)
+        }
+        return
+}
+
+// flush writes the buffered outputs of the job when it's done.
+func (out *jobOutput) flush() {
+        if lw, ok := out.stdout.(*lineWriter); ok { lw.flush() }
+        if lw, ok := out.stderr.(*lineWriter); ok { lw.flush() }
+        if out.so == nil || (out.so.Len() == 0 && out.se.Len() == 0) {
+                return
+        }
+        if out.module != nil {
+                dumpOutput(out.module, out.header, out.so.String(), out.se.String())
+                return
+        }
+        outputLock.Lock()
+        defer outputLock.Unlock()
+        dumpOutput(jobStdout, out.header, out.so.String(), out.se.String())
+}
+
+// flushModuleOutput writes the outputs of the module buffered in recurse
+// mode, it's called when the module is updated.
+func (ctx *Context) flushModuleOutput(m *Module) {
+        if b, ok := ctx.outputs[m]; ok {
+                delete(ctx.outputs, m)
+                if 0 < b.Len() {
+                        outputLock.Lock()
+                        defer outputLock.Unlock()
+                        jobStdout.Write(b.Bytes())
+                }
+        }
+}
@@ -0,0 +1,80 @@
+//
+//  Copyright (C) 2012-2016, Duzy Chan <code@duzy.info>, all rights reserverd.
+//
+package smart
+
+import (
+        "os"
+        "bytes"
+        "strings"
+        "testing"
+)
+
+func TestOutputLineWriter(t *testing.T) {
+        b := new(bytes.Buffer)
+        lw := &lineWriter{ w:b }
+        lw.Write([]byte("ab"))
+        if s := b.String(); s != "" { t.Errorf("partial line is written: '%v'", s) }
+        lw.Write([]byte("c\nd"))
+        if s, x := b.String(), "abc\n"; s != x { t.Errorf("'%v' != '%v'", s, x) }
+        lw.flush()
+        if s, x := b.String(), "abc\nd\n"; s != x { t.Errorf("'%v' != '%v'", s, x) }
+}
+
+func TestOutputDump(t *testing.T) {
+        sep := strings.Repeat("-", 80) + "\n"
+        b := new(bytes.Buffer)
+        dumpOutput(b, "foo", "out", "")
+        if s, x := b.String(), sep + "foo\n" + strings.Repeat("-", 73) + " stdout\nout\n" + sep; s != x { t.Errorf("'%v' != '%v'", s, x) }
+
+        // No header block without the header.
+        b.Reset()
+        dumpOutput(b, "", "", "err\n")
+        if s, x := b.String(), strings.Repeat("-", 73) + " stderr\nerr\n" + sep; s != x { t.Errorf("'%v' != '%v'", s, x) }
+}
+
+func TestOutputSyncTarget(t *testing.T) {
+        if wd, e := os.Getwd(); e != nil || workdir != wd { t.Errorf("%v != %v (%v)", workdir, wd, e) }
+
+        defer SetFlagJ(GetFlagJ())
+        defer SetFlagOutputSync(GetFlagOutputSync())
+        SetFlagJ(2)
+        SetFlagOutputSync("target")
+
+        so, se := jobStdout, jobStderr
+        defer func() { jobStdout, jobStderr = so, se }()
+        b := new(bytes.Buffer)
+        jobStdout, jobStderr = b, b
+
+        ctx, err := newTestContext("TestOutputSyncTarget", `
+all:!: a b
+a:!:
+	@echo a1; sleep 0.2; echo a2 >&2
+b:!:
+	@echo b1; sleep 0.1; echo b2
+`);     if err != nil { t.Errorf("parse error: %v", err) }
+
+        Update(ctx)
+
+        s := b.String()
+        for _, x := range []string{
+                `TestOutputSyncTarget:5: b
+------------------------------------------------------------------------- stdout
+b1
+b2
+--------------------------------------------------------------------------------
+`,
+                `TestOutputSyncTarget:3: a
+------------------------------------------------------------------------- stdout
+a1
+------------------------------------------------------------------------- stderr
+a2
+--------------------------------------------------------------------------------
+`,
+        } {
+                if !strings.Contains(s, x) { t.Errorf("'%v' not in '%v'", x, s) }
+        }
+        if i, j := strings.Index(s, ": b\n"), strings.Index(s, ": a\n"); !(0 <= i && i < j) {
+                t.Errorf("b is not written first: '%v'", s)
+        }
+}
@@ -14,9 +14,10 @@ import (
         "os/exec"
         //"path/filepath"
         //"reflect"
+        "regexp"
         "strings"
         "path/filepath"
-        "github.com/duzy/worker"
+        "sync"
 )
 
 type Item interface {
@@ -92,6 +93,9 @@ type rule struct {
         c checkupdater
         node *node
         kind rulekind
+        grouped bool // all targets are produced by one recipe run (&:)
+        expansion *node // prerequisites expanded again when matched (.SECONDEXPANSION)
+        module *Module // the module defining the rule, nil if it's global
 }
 
 type checkupdater interface {
@@ -104,8 +108,9 @@ type namespace interface {
         getDefineMap() map[string]*define
         //getRuleMap() map[string]*rule
         //addPattern(r *rule)
-        findMatchedRules(ctx *Context, target string) (m *match, rs []*rule)
+        findMatchedRule(ctx *Context, target string) (m *match, r *rule)
         isPhonyTarget(ctx *Context, target string) bool
+        isSpecialTarget(special, target string) bool
         saveDefines(names ...string) (saveIndex int, m map[string]*define)
         restoreDefines(saveIndex int)
         Set(ctx *Context, ids []string, items ...Item)
@@ -121,6 +126,8 @@ type namespaceEmbed struct {
         files map[string]*rule
         patts map[string]*rule
         pattList []*rule
+        vpaths []*vpath
+        targetDefines []*targetDefine
         goal string
 }
 func (ns *namespaceEmbed) getGoalRule() string { return ns.goal }
@@ -237,21 +244,94 @@ func (ns *namespaceEmbed) getRuleMap() map[string]*rule {
         return ns.files
 } */
 
-func (ns *namespaceEmbed) findMatchedRules(ctx *Context, target string) (m *match, rs []*rule) {
+// findMatchedRule selects the rule to update the target. A file rule of the
+// target is always selected, otherwise it's the pattern rule with the
+// shortest stem, rules whose prerequisites exist or can be made are
+// preferred, then the first declared one. Two equally specific rules which
+// could both build the target are reported (an error if `-strict` is set).
+func (ns *namespaceEmbed) findMatchedRule(ctx *Context, target string) (m *match, r *rule) {
         if rr, ok := ns.files[target]; ok && rr != nil {
                 if m, ok = rr.match(target); ok && m != nil {
-                        rs = append(rs, rr)
+                        r = rr
                 }
-        } else {
-                for _, rr := range ns.pattList {
-                        if m, ok = rr.match(target); ok && m != nil {
-                                rs = append(rs, rr) //; break // return
-                        }
+                return
+        }
+
+        var other *rule
+        var feasible bool
+        seen := make(map[*rule]bool, len(ns.pattList))
+        for _, rr := range ns.pattList {
+                if seen[rr] { continue } else { seen[rr] = true }
+                mm, ok := rr.match(target)
+                if !ok || mm == nil { continue }
+                f := ns.canMake(ctx, rr, mm)
+                switch {
+                case m == nil, len(mm.stem) < len(m.stem), len(mm.stem) == len(m.stem) && f && !feasible:
+                        m, r, feasible, other = mm, rr, f, nil
+                case len(mm.stem) == len(m.stem) && f && feasible && other == nil:
+                        other = rr
                 }
         }
+        if other != nil {
+                ctx.ambiguousRules(target, r, other)
+        }
         return
 }
 
+// canMake tells if all prerequisites of the matched rule exist or have
+// rules to make them.
+func (ns *namespaceEmbed) canMake(ctx *Context, r *rule, m *match) bool {
+        prerequisites := r.prerequisites
+        if r.expansion != nil {
+                prerequisites = r.expandPrerequisites(ctx, m)
+        }
+        for _, s := range prerequisites {
+                s, _ = m.unstem(s)
+                if _, ok := ns.files[s]; ok {
+                        continue
+                }
+                if _, err := statFile(s); err == nil {
+                        continue
+                }
+                var found bool
+                for _, rr := range ns.pattList {
+                        if _, found = rr.match(s); found { break }
+                }
+                if !found {
+                        return false
+                }
+        }
+        return true
+}
+
+// ambiguousRules reports the pattern rules equally specific to make the
+// target, it's reported once for each target. It's an error in strict mode
+// (-strict).
+func (ctx *Context) ambiguousRules(target string, r, other *rule) {
+        if ctx.ambiguous[target] {
+                return
+        } else if ctx.ambiguous == nil {
+                ctx.ambiguous = make(map[string]bool)
+        }
+        ctx.ambiguous[target] = true
+
+        level := "warning"
+        if *flagStrict { level = "error" }
+        s, lineno, colno := r.getLocation()
+        fmt.Fprintf(os.Stderr, "%v:%v:%v:%v: ambiguous pattern rules to make '%v'\n", s, lineno, colno, level, target)
+        for i, rr := range []*rule{ r, other } {
+                s, lineno, colno := rr.getLocation()
+                fmt.Fprintf(os.Stderr, "%v:%v:%v: %v", s, lineno, colno, strings.Join(rr.targets, " "))
+                if i == 0 && !*flagStrict {
+                        fmt.Fprintf(os.Stderr, " (selected)")
+                }
+                fmt.Fprintf(os.Stderr, "\n")
+        }
+        if *flagStrict {
+                errorf("%v:%v:%v: ambiguous pattern rules to make '%v'", s, lineno, colno, target)
+        }
+}
+
 func (ns *namespaceEmbed) isPhonyTarget(ctx *Context, target string) bool {
         if rr, ok := ns.files[target]; ok && rr != nil {
                 return rr.node.kind == nodeRulePhony
@@ -259,6 +339,62 @@ func (ns *namespaceEmbed) isPhonyTarget(ctx *Context, target string) bool {
         return false
 }
 
+// isSpecialTarget tells if a special target like `.ONESHELL` is declared to
+// apply to the target, it applies to all targets if there's no prerequisites.
+func (ns *namespaceEmbed) isSpecialTarget(special, target string) bool {
+        for ru, ok := ns.files[special]; ok && ru != nil; ru, ok = ru.prev[special] {
+                if len(ru.prerequisites) == 0 {
+                        return true
+                }
+                for _, s := range ru.prerequisites {
+                        if s == target { return true }
+                        if _, ok := matchPercent(s, target); ok { return true }
+                }
+        }
+        return false
+}
+
+// targetDefine is a target-specific variable, e.g. `foo.o: CFLAGS := -g`,
+// the targets can be `%` patterns.
+type targetDefine struct {
+        targets []string
+        d *define
+}
+
+// targetDefineRegexp matches target-specific variables in the prerequisites
+// text of a rule.
+var targetDefineRegexp = regexp.MustCompile(`^([A-Za-z_.][A-Za-z0-9_.\-]*)\s*(:{0,2}=)\s*(.*)$`)
+
+// getTargetDefines adds target-specific variables of the target to the map,
+// the last defined one wins.
+func (ns *namespaceEmbed) getTargetDefines(target string, vars map[string]Items) {
+        for _, td := range ns.targetDefines {
+                for _, s := range td.targets {
+                        if _, ok := matchPercent(s, target); s == target || ok {
+                                vars[td.d.name] = td.d.value
+                                break
+                        }
+                }
+        }
+}
+
+// matchPercent matches the target with a `%` pattern and returns the stem.
+func matchPercent(pat, target string) (stem string, ok bool) {
+        if pos := strings.Index(pat, "%"); 0 <= pos {
+                prefix, suffix := pat[0:pos], pat[pos+1:]
+                if ok = len(prefix) + len(suffix) <= len(target) &&
+                        strings.HasPrefix(target, prefix) && strings.HasSuffix(target, suffix); ok {
+                        stem = target[len(prefix):len(target)-len(suffix)]
+                }
+        }
+        return
+}
+
+// isSpecialName tells if the name is special like `.ONESHELL`, `.PRECIOUS`.
+func isSpecialName(s string) bool {
+        return strings.HasPrefix(s, ".") && !strings.Contains(s, "/")
+}
+
 type nodeType int
 
 const (
@@ -282,6 +418,7 @@ const (
         nodeRulePhony           // :!:    phony target
         nodeRuleChecker         // :?:    check if the target is updated
         nodeTargets
+        nodeGroupedTargets      // targets &:
         nodePrerequisites
         nodeRecipes
         nodeRecipe
@@ -293,6 +430,7 @@ const (
         nodeCommit              // commit
         nodePost                // post
         nodeUse                 // use name
+        nodeVpath               // vpath pattern dirs
 )
 
 var (
@@ -303,6 +441,7 @@ var (
                 "commit":       nodeCommit,
                 "post":         nodePost,
                 "use":          nodeUse,
+                "vpath":        nodeVpath,
         }
 
         processors = map[nodeType]func(ctx *Context, n *node)(err error){
@@ -325,6 +464,7 @@ var (
                 nodeCommit:                     processNodeCommit,
                 //nodePost:                     
                 nodeUse:                        processNodeUse,
+                nodeVpath:                      processNodeVpath,
         }
 
         /*
@@ -360,6 +500,7 @@ var (
                 nodeRulePhony:                  "rule-phony",
                 nodeRuleChecker:                "rule-checker",
                 nodeTargets:                    "targets",
+                nodeGroupedTargets:             "grouped-targets",
                 nodePrerequisites:              "prerequisites",
                 nodeRecipes:                    "recipes",
                 nodeRecipe:                     "recipe",
@@ -371,6 +512,7 @@ var (
                 nodeCommit:                     "commit",
                 nodePost:                       "post",
                 nodeUse:                        "use",
+                nodeVpath:                      "vpath",
         }
 )
 
@@ -946,6 +1088,9 @@ func (l *lex) stateRule() {
 
         targets := l.pop().node
         targets.kind = nodeTargets
+        if e := targets.end; targets.pos < e && l.s[e-1] == '&' { // targets &:
+                targets.kind, targets.end = nodeGroupedTargets, l.backwardNonSpace(targets.pos, e-1)
+        }
 
         st := l.push(t, l.stateAppendNode, 0)
         st.node.children = []*node{ targets }
@@ -959,6 +1104,23 @@ func (l *lex) stateRule() {
         fmt.Fprintf(os.Stderr, "%v:%v:%v: stateRule: %v\n", l.scope, lineno, colno, st.node.children[0].str()) //*/
 }
 
+// parseText parses the string as prerequisites of a rule.
+func parseText(scope, s string) (n *node) {
+        l := &lex{ parseBuffer:&parseBuffer{ scope:scope, s:[]byte(s) } }
+        l.step = func() { l.pos = len(l.s) } // drops anything after the line
+        n = l.push(nodePrerequisites, l.stateRuleTextLine, 0).node
+        for end := len(l.s); l.pos < end; {
+                l.step()
+        }
+        for 0 < len(l.stack) {
+                t := l.top()
+                if l.step(); t == l.top() {
+                        l.pop()
+                }
+        }
+        return
+}
+
 func (l *lex) stateRuleTextLine() {
         st := l.top()
 state_loop:
@@ -1373,7 +1535,22 @@ type Context struct {
         moduleOrderList []*Module
         moduleBuildList []pendedBuild
 
-        w *worker.Worker
+        mu sync.Mutex // held by the task evaluating rules
+        task *task // the task holding the context
+        auto map[string]Items // automatic and target-specific variables of the recipe being expanded
+        tasks map[interface{}]*task // tasks started in the current update
+        wg sync.WaitGroup
+        failed error // the first failure of the current update
+        failures []*failure // targets failed in the current update
+        stop chan bool // closed on the first failure
+        stale bool // a target is not up to date in question mode (-q)
+        outputs map[*Module]*bytes.Buffer // outputs of modules in recurse output sync mode
+        pools []*pool // job pools of the current update
+        db *database // the build database
+        cache *actionCache // the action cache, nil if disabled
+        used map[string]Items // variables used by the recipes being expanded
+        quiet bool // expanding recipes without side effects (e.g. info)
+        ambiguous map[string]bool // targets reported to have ambiguous pattern rules
 }
 
 func (ctx *Context) GetModules() map[string]*Module { return ctx.modules }
@@ -1469,6 +1646,10 @@ func (ctx *Context) callWithDetails(loc location, hasPrefix bool, prefix string,
                 case "me": // rename: $(me) -> $(me.name)
                         parts, n = append(parts, "name"), 2
                 default:
+                        if a, ok := ctx.auto[sym]; ok {
+                                is = a
+                                return
+                        }
                         if f, ok := builtins[sym]; ok && f != nil {
                                 is = f(ctx, loc, args)
                                 return
@@ -1489,6 +1670,11 @@ func (ctx *Context) callWithDetails(loc location, hasPrefix bool, prefix string,
                         if !hooked {
                                 if d, ok := m[sym]; ok && d != nil {
                                         is = d.value
+                                        if name := strings.Join(parts, "."); ctx.used != nil && hasPrefix {
+                                                ctx.used[prefix + ":" + name] = is
+                                        } else if ctx.used != nil {
+                                                ctx.used[name] = is
+                                        }
                                 }
                         }
                 }
@@ -1612,10 +1798,19 @@ func (ctx *Context) expandNameString(name string) (hasPrefix bool, prefix string
                 prefix, hasPrefix = name[0:i], true
                 name = name[i+1:]
         }
-        parts = strings.Split(name, ".")
+        parts = specialNameParts(strings.Split(name, "."))
         return
 }
 
+// specialNameParts joins the leading '.' to the first name part, so special
+// names like `.SHELLFLAGS` are global symbols instead of nested names.
+func specialNameParts(parts []string) []string {
+        if 1 < len(parts) && parts[0] == "" {
+                parts = append([]string{ "." + parts[1] }, parts[2:]...)
+        }
+        return parts
+}
+
 func (ctx *Context) expandNameNode(n *node) (scoped bool, name string, parts []string) {
         pos := 0
         b, i := ctx.multipart(n)
@@ -1628,7 +1823,7 @@ func (ctx *Context) expandNameNode(n *node) (scoped bool, name string, parts []s
                 parts = append(parts, string(b.Bytes()[pos:n-1]))
                 pos = n
         }
-        parts = append(parts, string(b.Bytes()[pos:]))
+        parts = specialNameParts(append(parts, string(b.Bytes()[pos:])))
         return
 }
 
@@ -1685,6 +1880,7 @@ func (ctx *Context) nodeItems(n *node) (is Items) {
         case nodeRecipe:        fallthrough
         case nodeDeferredText:  fallthrough
         case nodeTargets:       fallthrough
+        case nodeGroupedTargets: fallthrough
         case nodePrerequisites: fallthrough
         case nodeImmediateText:
                 var (
@@ -1871,8 +2067,37 @@ func processNodeRule(ctx *Context, n *node) (err error) {
                 ns = ctx.m
         }
 
-        r := ns.link(Split(ctx.nodeItems(n.children[0]).Expand(ctx))...)
-        r.prerequisites, r.node = Split(ctx.nodeItems(n.children[1]).Expand(ctx)), n
+        // Target-specific variables are bound to jobs updating the targets,
+        // the value of `=` is expanded in the job.
+        if sm := targetDefineRegexp.FindStringSubmatch(n.children[1].str()); sm != nil && n.kind == nodeRuleSingleColoned && len(n.children) == 2 {
+                td := &targetDefine{ Split(ctx.nodeItems(n.children[0]).Expand(ctx)), &define{ name:sm[1], loc:n.loc() } }
+                if value := parseText(ctx.l.scope, sm[3]); sm[2] == "=" {
+                        td.d.value = Items{ value }
+                } else {
+                        td.d.value = Items{ stringitem(value.Expand(ctx)) }
+                }
+                if ctx.m == nil {
+                        ctx.g.targetDefines = append(ctx.g.targetDefines, td)
+                } else {
+                        ctx.m.targetDefines = append(ctx.m.targetDefines, td)
+                }
+                return
+        }
+
+        r := ns.link(expandArchiveMembers(Split(ctx.nodeItems(n.children[0]).Expand(ctx)))...)
+        prerequisites := ctx.nodeItems(n.children[1]).Expand(ctx)
+        r.prerequisites, r.node = expandArchiveMembers(Split(prerequisites)), n
+        r.ns, r.module = ns, ctx.m // the module instead of the embedded namespace
+
+        // After `.SECONDEXPANSION`, prerequisites like `$$(@D)/.dirstamp` are
+        // expanded again when the rule is matched.
+        if 0 < len(r.targets) && strings.Contains(prerequisites, "$") && r.isSpecial(ctx, ".SECONDEXPANSION", "", r.targets[0]) {
+                r.expansion = parseText(ctx.l.scope, prerequisites)
+        }
+
+        // Multi-target pattern rules are always grouped, as GNU make does.
+        r.grouped = n.children[0].kind == nodeGroupedTargets ||
+                (r.kind == rulePercentPattern && 1 < len(r.targets))
         if 2 < len(n.children) {
                 for _, c := range n.children[2].children {
                         r.recipes = append(r.recipes, c)
@@ -1880,7 +2105,7 @@ func processNodeRule(ctx *Context, n *node) (err error) {
         }
 
         // Set goal rule if nil
-        if 0 < len(r.targets) {
+        if 0 < len(r.targets) && !isSpecialName(r.targets[0]) {
                 if g := r.ns.getGoalRule(); g == "" {
                         r.ns.setGoalRule(r.targets[0])
                 }
@@ -2152,7 +2377,6 @@ func NewContext(scope string, s []byte, vars map[string]string) (ctx *Context, e
                         files: make(map[string]*rule, 8),
                         patts: make(map[string]*rule, 2),
                 },
-                w: worker.New(),
         }
 
         for k, v := range vars {
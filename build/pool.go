@@ -0,0 +1,172 @@
+//
+//  Copyright (C) 2012-2016, Duzy Chan <code@duzy.info>, all rights reserverd.
+//
+package smart
+
+import (
+        "io/ioutil"
+        "strconv"
+        "strings"
+        "sync"
+        "sync/atomic"
+        "time"
+)
+
+// Pools limit the number of jobs running heavy recipes (e.g. linking),
+// like ninja pools. Pools are declared with their depths in `.POOLS`, and
+// targets join a pool by the special target `.POOL.<name>` or the module
+// variable `me.pool`. A job takes one slot of the pool, or as many as the
+// weight given by the special target `.WEIGHT.<n>` or `me.weight`, a job
+// heavier than the pool runs alone. If several pools are joined, the first
+// declared one is used. E.g.
+//
+//      .POOLS := link=4 package=2
+//      .POOL.link: %.so
+//      .WEIGHT.2: libbig.so
+//
+//      module foo
+//      me.pool := package
+//      ...
+//      commit
+
+// pool is a named pool, it counts the slots taken by running jobs.
+type pool struct {
+        name string
+        depth, used int
+        mu sync.Mutex
+        cond *sync.Cond
+}
+
+// makePools creates pools declared in `.POOLS`, in the declared order.
+func (ctx *Context) makePools() (pools []*pool) {
+        d, ok := ctx.g.defines[".POOLS"]
+        if !ok || d == nil {
+                return
+        }
+        for _, s := range Split(d.value.Expand(ctx)) {
+                var name, depth string
+                if i := strings.Index(s, "="); 0 < i {
+                        name, depth = s[:i], s[i+1:]
+                }
+                n, err := strconv.Atoi(depth)
+                if name == "" || err != nil || n < 1 {
+                        errorf("invalid pool '%v' (expects name=depth)", s)
+                }
+                p := &pool{ name:name, depth:n }
+                p.cond = sync.NewCond(&p.mu)
+                pools = append(pools, p)
+        }
+        return
+}
+
+// findPool returns the pool of the name, or nil.
+func (ctx *Context) findPool(name string) *pool {
+        for _, p := range ctx.pools {
+                if p.name == name { return p }
+        }
+        return nil
+}
+
+// getPool returns the pool joined by the target of the rule (or nil) and
+// the weight of the job.
+func (r *rule) getPool(ctx *Context, target string) (p *pool, weight int) {
+        for _, x := range ctx.pools {
+                if ctx.g.isSpecialTarget(".POOL." + x.name, target) || r.ns.isSpecialTarget(".POOL." + x.name, target) {
+                        p = x
+                        break
+                }
+        }
+        m := r.module
+        if p == nil && m != nil {
+                if name := strings.TrimSpace(m.Get(ctx, "pool")); name != "" {
+                        if p = ctx.findPool(name); p == nil {
+                                s, lineno, colno := r.getLocation()
+                                errorf("%v:%v:%v: unknown pool '%v'", s, lineno, colno, name)
+                        }
+                }
+        }
+        if p == nil {
+                return
+        }
+
+        // The heaviest weight of the target is used.
+        var weights []string
+        namespaces := []*namespaceEmbed{ ctx.g }
+        if m != nil {
+                namespaces = append(namespaces, m.namespaceEmbed)
+        }
+        for _, ns := range namespaces {
+                for special := range ns.files {
+                        if strings.HasPrefix(special, ".WEIGHT.") && ns.isSpecialTarget(special, target) {
+                                weights = append(weights, special[len(".WEIGHT."):])
+                        }
+                }
+        }
+        if m != nil {
+                if s := strings.TrimSpace(m.Get(ctx, "weight")); s != "" {
+                        weights = append(weights, s)
+                }
+        }
+        weight = 1
+        for _, s := range weights {
+                n, err := strconv.Atoi(s)
+                if err != nil || n < 1 {
+                        loc, lineno, colno := r.getLocation()
+                        errorf("%v:%v:%v: invalid weight '%v'", loc, lineno, colno, s)
+                }
+                if weight < n { weight = n }
+        }
+        return
+}
+
+// acquire takes slots of the weight, it waits until they're free or no
+// other jobs are running in the pool.
+func (p *pool) acquire(weight int) {
+        if p == nil { return }
+        p.mu.Lock()
+        for 0 < p.used && p.depth < p.used + weight {
+                p.cond.Wait()
+        }
+        p.used += weight
+        p.mu.Unlock()
+}
+
+func (p *pool) release(weight int) {
+        if p == nil { return }
+        p.mu.Lock()
+        p.used -= weight
+        p.cond.Broadcast()
+        p.mu.Unlock()
+}
+
+// activeJobs is the number of jobs running recipes.
+var activeJobs int32
+
+// loadCheckInterval is the time to wait before checking the load again.
+var loadCheckInterval = 100 * time.Millisecond
+
+// loadAverage returns the one minute load average of the system.
+var loadAverage = func() (float64, error) {
+        b, err := ioutil.ReadFile("/proc/loadavg")
+        if err != nil {
+                return 0, err
+        }
+        s := strings.Fields(string(b))
+        if len(s) == 0 {
+                return 0, nil
+        }
+        return strconv.ParseFloat(s[0], 64)
+}
+
+// waitLoad holds back a new job while the load average is not below the
+// limit (-load-average), unless no other jobs are running.
+func waitLoad() {
+        for max := *flagLoadAverage; 0 < max; time.Sleep(loadCheckInterval) {
+                if atomic.LoadInt32(&activeJobs) == 0 {
+                        return
+                }
+                if l, err := loadAverage(); err != nil || l < max {
+                        return
+                }
+        }
+}
@@ -0,0 +1,133 @@
+//
+//  Copyright (C) 2012-2016, Duzy Chan <code@duzy.info>, all rights reserverd.
+//
+package smart
+
+import (
+        "os"
+        "sync"
+        "time"
+        "testing"
+)
+
+func TestPools(t *testing.T) {
+        if wd, e := os.Getwd(); e != nil || workdir != wd { t.Errorf("%v != %v (%v)", workdir, wd, e) }
+
+        defer SetFlagJ(GetFlagJ())
+        SetFlagJ(4)
+
+        ctx, err := newTestContext("TestPools", `
+.POOLS := link=1 package=2
+.POOL.link: %.so
+
+all:!: a.so b.so c.so
+%.so:
+	@mkdir so.lock && sleep 0.2 && rmdir so.lock && touch $@
+
+module foo
+me.pool := package
+foo:!: x.txt
+x.txt:
+	@touch $@
+commit
+`);     if err != nil { t.Errorf("parse error: %v", err) }
+
+        if n := len(ctx.makePools()); n != 2 { t.Errorf("pools: %v", n) }
+
+        os.Remove("a.so")
+        os.Remove("b.so")
+        os.Remove("c.so")
+        os.Remove("x.txt")
+
+        start := time.Now()
+        Update(ctx, "all", "foo")
+        if d := time.Since(start); d < 600*time.Millisecond {
+                t.Errorf("jobs of pool 'link' run in parallel: %v", d)
+        }
+        for _, s := range []string{ "a.so", "b.so", "c.so", "x.txt" } {
+                if _, e := os.Stat(s); e != nil { t.Errorf("%v", e) }
+                os.Remove(s)
+        }
+
+        r := ctx.modules["foo"].files["x.txt"]
+        if p, w := r.getPool(ctx, "x.txt"); p == nil || p.name != "package" || w != 1 { t.Errorf("pool: %v %v", p, w) }
+        r = ctx.g.patts["%.so"]
+        if p, w := r.getPool(ctx, "a.so"); p == nil || p.name != "link" || w != 1 { t.Errorf("pool: %v %v", p, w) }
+}
+
+func TestPoolWeights(t *testing.T) {
+        ctx, err := newTestContext("TestPoolWeights", `
+.POOLS := link=2 heavy=1 package=2
+.POOL.heavy: %.so
+.POOL.link: %.so %.a
+.WEIGHT.2: %.so
+.WEIGHT.3: big.so
+%.so:
+%.a:
+
+module foo
+me.pool := package
+me.weight := 2
+x.txt:
+commit
+`);     if err != nil { t.Errorf("parse error: %v", err) }
+
+        ctx.pools = ctx.makePools()
+        for _, c := range []struct{ r *rule; target, pool string; weight int }{
+                { ctx.g.patts["%.so"], "a.so", "link", 2 }, // the first declared pool
+                { ctx.g.patts["%.so"], "big.so", "link", 3 }, // the heaviest weight
+                { ctx.g.patts["%.a"], "a.a", "link", 1 },
+                { ctx.modules["foo"].files["x.txt"], "x.txt", "package", 2 },
+        } {
+                if p, w := c.r.getPool(ctx, c.target); p == nil || p.name != c.pool || w != c.weight { t.Errorf("%v: pool: %v %v", c.target, p, w) }
+        }
+
+        p := ctx.findPool("link")
+        p.acquire(1)
+        done := make(chan bool)
+        go func() { p.acquire(2); close(done) }()
+        select {
+        case <-done: t.Errorf("not held back")
+        case <-time.After(50*time.Millisecond):
+        }
+        p.release(1)
+        select {
+        case <-done:
+        case <-time.After(time.Second): t.Errorf("still held back")
+        }
+        p.release(2)
+
+        // Heavier than the pool, it runs alone.
+        p.acquire(3)
+        p.release(3)
+}
+
+func TestLoadAverage(t *testing.T) {
+        defer SetFlagLoadAverage(GetFlagLoadAverage())
+        defer func(f func() (float64, error)) { loadAverage = f }(loadAverage)
+
+        var mu sync.Mutex
+        load := 8.0
+        loadAverage = func() (float64, error) { mu.Lock(); defer mu.Unlock(); return load, nil }
+        defer func(d time.Duration) { loadCheckInterval = d }(loadCheckInterval)
+        loadCheckInterval = 10*time.Millisecond
+
+        SetFlagLoadAverage(4)
+        waitLoad() // no jobs running
+
+        activeJobs = 1
+        defer func() { activeJobs = 0 }()
+        done := make(chan bool)
+        go func() { waitLoad(); close(done) }()
+        select {
+        case <-done: t.Errorf("not held back")
+        case <-time.After(50*time.Millisecond):
+        }
+        mu.Lock()
+        load = 2
+        mu.Unlock()
+        select {
+        case <-done:
+        case <-time.After(time.Second): t.Errorf("still held back")
+        }
+}
@@ -0,0 +1,262 @@
+//
+//  Copyright (C) 2012-2016, Duzy Chan <code@duzy.info>, all rights reserverd.
+//
+package smart
+
+import (
+        "bytes"
+        "encoding/json"
+        "fmt"
+        "io"
+        "io/ioutil"
+        "net/http"
+        "os"
+        "strings"
+        "sync"
+        "time"
+)
+
+// The remote cache shares action results and outputs over HTTP, it's
+// enabled by `-remote-cache=url` or the environment variable
+// `SMART_REMOTE_CACHE`. The protocol is simply:
+//
+//      GET/HEAD/PUT <url>/ac/<key>     action results in JSON
+//      GET/HEAD/PUT <url>/cas/<sum>    outputs by their sha1 sums
+//
+// `smart cache-server [address]` serves the cache directory (`-cache` or
+// `SMART_CACHE`) in this protocol. Failures of the remote cache never fail
+// the build, the remote cache is disabled with a warning and targets are
+// built locally.
+
+// remoteCache is the client of a remote cache.
+type remoteCache struct {
+        url string
+        client *http.Client
+
+        mu sync.Mutex // guards err
+        err error // the remote cache is disabled if not nil
+}
+
+// remoteCacheTimeout limits each request, a slow remote cache is disabled
+// rather than slowing down the build.
+const remoteCacheTimeout = 5*time.Second
+
+// remoteCacheURL returns the URL of the remote cache, or "" if it's
+// disabled.
+func remoteCacheURL() string {
+        if *flagRemoteCache != "" {
+                return *flagRemoteCache
+        }
+        return os.Getenv("SMART_REMOTE_CACHE")
+}
+
+func openRemoteCache() *remoteCache {
+        if url := remoteCacheURL(); url != "" {
+                return &remoteCache{
+                        url: strings.TrimSuffix(url, "/"),
+                        client: &http.Client{ Timeout:remoteCacheTimeout },
+                }
+        }
+        return nil
+}
+
+// fail disables the remote cache with a warning.
+func (rc *remoteCache) fail(err error) {
+        rc.mu.Lock()
+        defer rc.mu.Unlock()
+        if rc.err == nil {
+                rc.err = err
+                fmt.Fprintf(os.Stderr, "smart: remote cache unavailable (%v), building locally\n", err)
+        }
+}
+
+func (rc *remoteCache) available() bool {
+        if rc == nil {
+                return false
+        }
+        rc.mu.Lock()
+        defer rc.mu.Unlock()
+        return rc.err == nil
+}
+
+// do sends the request, it returns the response if the status is 200, or
+// nil if it's 404.
+func (rc *remoteCache) do(method, path string, body io.Reader) (res *http.Response, err error) {
+        var req *http.Request
+        if req, err = http.NewRequest(method, rc.url + path, body); err != nil {
+                return
+        }
+        if res, err = rc.client.Do(req); err != nil {
+                return nil, err
+        }
+        switch res.StatusCode {
+        case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+                return
+        case http.StatusNotFound:
+                res.Body.Close()
+                return nil, nil
+        default:
+                res.Body.Close()
+                return nil, fmt.Errorf("%v %v: %v", method, rc.url + path, res.Status)
+        }
+}
+
+// get returns the action result of the key, or nil.
+func (rc *remoteCache) get(key string) (res *actionResult) {
+        if !rc.available() {
+                return nil
+        }
+        resp, err := rc.do("GET", "/ac/" + key, nil)
+        if err != nil {
+                rc.fail(err)
+                return nil
+        } else if resp == nil {
+                return nil
+        }
+        defer resp.Body.Close()
+        if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+                rc.fail(fmt.Errorf("action result '%v': %v", key, err))
+                return nil
+        }
+        return
+}
+
+// fetch downloads the output to the file, the content is checked by the sum.
+func (rc *remoteCache) fetch(name, sum string, mode os.FileMode) (err error) {
+        var resp *http.Response
+        if resp, err = rc.do("GET", "/cas/" + sum, nil); err == nil && resp == nil {
+                err = fmt.Errorf("output '%v' is missing", sum)
+        }
+        if err != nil {
+                rc.fail(err)
+                return
+        }
+        defer resp.Body.Close()
+        if err = writeFileSum(name, resp.Body, mode, sum); err == errBrokenContent {
+                err = fmt.Errorf("output '%v' is broken", sum)
+        }
+        if err != nil {
+                rc.fail(err)
+        }
+        return
+}
+
+// store uploads the outputs and the action result.
+func (rc *remoteCache) store(key string, res *actionResult) {
+        if !rc.available() {
+                return
+        }
+        for _, out := range res.Outputs {
+                if resp, err := rc.do("HEAD", "/cas/" + out.Sum, nil); err != nil {
+                        rc.fail(err)
+                        return
+                } else if resp != nil {
+                        resp.Body.Close()
+                        continue // already uploaded
+                }
+                if err := rc.put("/cas/" + out.Sum, out.Name); err != nil {
+                        rc.fail(err)
+                        return
+                }
+        }
+        b, err := json.Marshal(res)
+        if err == nil {
+                var resp *http.Response
+                if resp, err = rc.do("PUT", "/ac/" + key, bytes.NewReader(b)); resp != nil {
+                        resp.Body.Close()
+                }
+        }
+        if err != nil {
+                rc.fail(err)
+        }
+}
+
+func (rc *remoteCache) put(path, name string) (err error) {
+        var f *os.File
+        if f, err = os.Open(name); err != nil {
+                return
+        }
+        defer f.Close()
+        var resp *http.Response
+        if resp, err = rc.do("PUT", path, f); err == nil && resp != nil {
+                resp.Body.Close()
+        }
+        return
+}
+
+// cacheServer serves the cache directory in the remote cache protocol.
+type cacheServer struct {
+        cache *actionCache
+}
+
+func (s *cacheServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+        var name string
+        parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+        if len(parts) == 2 && isSum(parts[1]) {
+                switch parts[0] {
+                case "ac": name = s.cache.resultPath(parts[1])
+                case "cas": name = s.cache.blobPath(parts[1])
+                }
+        }
+        if name == "" {
+                http.NotFound(w, req)
+                return
+        }
+        switch req.Method {
+        case "GET", "HEAD":
+                f, err := os.Open(name)
+                if err != nil {
+                        http.NotFound(w, req)
+                        return
+                }
+                defer f.Close()
+                now := time.Now()
+                os.Chtimes(name, now, now)
+                if fi, err := f.Stat(); err == nil {
+                        w.Header().Set("Content-Length", fmt.Sprint(fi.Size()))
+                }
+                if req.Method == "GET" {
+                        io.Copy(w, f)
+                }
+        case "PUT":
+                var err error
+                if parts[0] == "cas" {
+                        if err = writeFileSum(name, req.Body, 0644, parts[1]); err == errBrokenContent {
+                                http.Error(w, err.Error(), http.StatusBadRequest)
+                                return
+                        }
+                } else {
+                        var b []byte
+                        var res actionResult
+                        if b, err = ioutil.ReadAll(req.Body); err == nil {
+                                if e := json.Unmarshal(b, &res); e != nil {
+                                        http.Error(w, e.Error(), http.StatusBadRequest)
+                                        return
+                                }
+                                err = writeFile(name, bytes.NewReader(b), 0644)
+                        }
+                }
+                if err != nil {
+                        http.Error(w, err.Error(), http.StatusInternalServerError)
+                        return
+                }
+                w.WriteHeader(http.StatusCreated)
+        default:
+                http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        }
+}
+
+// cacheServerCommand runs `smart cache-server [address]`.
+func cacheServerCommand(args []string) error {
+        dir, addr := cacheDir(), "localhost:7420"
+        if dir == "" {
+                return fmt.Errorf("cache is not enabled (use -cache=dir or SMART_CACHE)")
+        }
+        if 1 < len(args) {
+                return fmt.Errorf("usage: smart cache-server [address]")
+        } else if len(args) == 1 {
+                addr = args[0]
+        }
+        message("serving cache '%v' on %v", dir, addr)
+        return http.ListenAndServe(addr, &cacheServer{ &actionCache{ dir:dir } })
+}
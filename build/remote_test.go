@@ -0,0 +1,166 @@
+//
+//  Copyright (C) 2012-2016, Duzy Chan <code@duzy.info>, all rights reserverd.
+//
+package smart
+
+import (
+        "os"
+        "strings"
+        "testing"
+        "io/ioutil"
+        "net/http"
+        "net/http/httptest"
+        "path/filepath"
+)
+
+func TestRemoteCache(t *testing.T) {
+        if wd, e := os.Getwd(); e != nil || workdir != wd { t.Errorf("%v != %v (%v)", workdir, wd, e) }
+
+        dir, err := ioutil.TempDir("", "smart-cache-server")
+        if err != nil { t.Fatalf("%v", err) }
+        defer os.RemoveAll(dir)
+
+        server := httptest.NewServer(&cacheServer{ &actionCache{ dir:dir } })
+        defer server.Close()
+
+        defer SetFlagRemoteCache(GetFlagRemoteCache())
+        SetFlagRemoteCache(server.URL)
+        os.Remove(databasePath())
+        defer os.Remove(databasePath())
+
+        ctx, err := newTestContext("TestRemoteCache", `
+foo.txt: bar.txt
+	@cat $< > $@; echo run >> foo.log
+bar.txt:
+`);     if err != nil { t.Errorf("parse error: %v", err) }
+
+        os.Remove("foo.txt")
+        os.Remove("foo.log")
+        defer os.Remove("foo.txt")
+        defer os.Remove("foo.log")
+        defer os.Remove("bar.txt")
+
+        check := func(s, content string) {
+                if b, e := ioutil.ReadFile("foo.log"); e != nil || string(b) != s { t.Errorf("'%s' != '%v' (%v)", b, s, e) }
+                if b, e := ioutil.ReadFile("foo.txt"); e != nil || string(b) != content { t.Errorf("'%s' != '%v' (%v)", b, content, e) }
+        }
+
+        ioutil.WriteFile("bar.txt", []byte("bar\n"), 0644)
+        Update(ctx, "foo.txt")
+        check("run\n", "bar\n")
+        if files, _ := (&actionCache{ dir:dir }).files(); len(files) != 2 { t.Errorf("not uploaded: %v", len(files)) }
+
+        // Downloaded by another checkout.
+        os.Remove("foo.txt")
+        os.Remove(databasePath())
+        Update(ctx, "foo.txt")
+        check("run\n", "bar\n")
+
+        // Also kept in the local cache.
+        local, err := ioutil.TempDir("", "smart-cache")
+        if err != nil { t.Fatalf("%v", err) }
+        defer os.RemoveAll(local)
+        defer SetFlagCache(GetFlagCache())
+        SetFlagCache(local)
+        os.Remove("foo.txt")
+        Update(ctx, "foo.txt")
+        check("run\n", "bar\n")
+        if s := (&actionCache{ dir:local }).loadStats(); s.RemoteHits != 1 || s.Hits != 0 { t.Errorf("stats: %+v", s) }
+        server.Close()
+        os.Remove("foo.txt")
+        Update(ctx, "foo.txt")
+        check("run\n", "bar\n")
+        if s := (&actionCache{ dir:local }).loadStats(); s.Hits != 1 { t.Errorf("stats: %+v", s) }
+}
+
+func TestRemoteCacheFailure(t *testing.T) {
+        if wd, e := os.Getwd(); e != nil || workdir != wd { t.Errorf("%v != %v (%v)", workdir, wd, e) }
+
+        server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+                http.Error(w, "broken", http.StatusInternalServerError)
+        }))
+        defer server.Close()
+
+        defer SetFlagRemoteCache(GetFlagRemoteCache())
+        SetFlagRemoteCache(server.URL)
+        os.Remove(databasePath())
+        defer os.Remove(databasePath())
+
+        ctx, err := newTestContext("TestRemoteCacheFailure", `
+foo.txt:
+	@echo foo > $@
+`);     if err != nil { t.Errorf("parse error: %v", err) }
+
+        os.Remove("foo.txt")
+        defer os.Remove("foo.txt")
+        s := captureStderr(func() { Update(ctx, "foo.txt") })
+        if b, e := ioutil.ReadFile("foo.txt"); e != nil || string(b) != "foo\n" { t.Errorf("'%s' (%v)", b, e) }
+        if strings.Count(s, "remote cache unavailable") != 1 { t.Errorf("warning: '%v'", s) }
+}
+
+func TestCacheServer(t *testing.T) {
+        dir, err := ioutil.TempDir("", "smart-cache-server")
+        if err != nil { t.Fatalf("%v", err) }
+        defer os.RemoveAll(dir)
+
+        server := httptest.NewServer(&cacheServer{ &actionCache{ dir:dir } })
+        defer server.Close()
+
+        rc := &remoteCache{ url:server.URL, client:http.DefaultClient }
+        sum := "0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33" // sha1("foo")
+        for _, c := range []struct{ method, path, body string; status int }{
+                { "GET", "/cas/" + sum, "", 404 },
+                { "PUT", "/cas/" + sum, "bar", 400 },
+                { "PUT", "/cas/" + sum, "foo", 201 },
+                { "HEAD", "/cas/" + sum, "", 200 },
+                { "PUT", "/cas/" + sum, "bar", 400 }, // the blob is kept
+                { "PUT", "/ac/" + sum, "{", 400 },
+                { "PUT", "/ac/" + sum, `{"outputs":[]}`, 201 },
+                { "GET", "/ac/foo", "", 404 },
+                { "DELETE", "/ac/" + sum, "", 405 },
+        } {
+                req, _ := http.NewRequest(c.method, server.URL + c.path, strings.NewReader(c.body))
+                if res, err := http.DefaultClient.Do(req); err != nil { t.Errorf("%v", err) } else {
+                        res.Body.Close()
+                        if res.StatusCode != c.status { t.Errorf("%v %v: %v != %v", c.method, c.path, res.StatusCode, c.status) }
+                }
+        }
+        if res := rc.get(sum); res == nil || rc.err != nil { t.Errorf("result: %v (%v)", res, rc.err) }
+
+        name := dir + "/foo.out"
+        if err := rc.fetch(name, sum, 0644); err != nil { t.Errorf("%v", err) }
+        if b, e := ioutil.ReadFile(name); e != nil || string(b) != "foo" { t.Errorf("'%s' (%v)", b, e) }
+        if files, _ := filepath.Glob(dir + "/*/*/.tmp*"); len(files) != 0 { t.Errorf("temp files: %v", files) }
+}
+
+func TestRemoteCacheForged(t *testing.T) {
+        dir, err := ioutil.TempDir("", "smart-cache-server")
+        if err != nil { t.Fatalf("%v", err) }
+        defer os.RemoveAll(dir)
+
+        server := httptest.NewServer(&cacheServer{ &actionCache{ dir:dir } })
+        defer server.Close()
+
+        c := &actionCache{ remote:&remoteCache{ url:server.URL, client:http.DefaultClient } }
+        sum, key := "0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33", strings.Repeat("0", 40) // sha1("foo")
+        put := func(path, body string) {
+                req, _ := http.NewRequest("PUT", server.URL + path, strings.NewReader(body))
+                if res, err := http.DefaultClient.Do(req); err != nil { t.Errorf("%v", err) } else { res.Body.Close() }
+        }
+        put("/cas/" + sum, "foo")
+
+        // Anyone could write the results, outputs other than the targets
+        // are never written.
+        for _, s := range []string{
+                `{"outputs":[{"name":"../forged.txt","sum":"` + sum + `","mode":420}]}`,
+                `{"outputs":[{"name":"` + dir + `/forged.txt","sum":"` + sum + `","mode":420}]}`,
+                `{"outputs":[{"name":"forged.txt","sum":"` + sum + `","mode":420}]}`,
+                `{"outputs":[{"name":"foo.txt","sum":"../../forged","mode":420}]}`,
+        } {
+                put("/ac/" + key, s)
+                if res, err := c.restore(key, []string{ "foo.txt" }); err == nil || res != nil { t.Errorf("restored: %v", s) }
+        }
+        for _, s := range []string{ "../forged.txt", dir + "/forged.txt", "forged.txt", "foo.txt" } {
+                if _, e := os.Stat(s); e == nil { os.Remove(s); t.Errorf("%v is written", s) }
+        }
+}
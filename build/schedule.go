@@ -0,0 +1,307 @@
+//
+//  Copyright (C) 2012-2016, Duzy Chan <code@duzy.info>, all rights reserverd.
+//
+package smart
+
+import (
+        "bytes"
+        "errors"
+        "fmt"
+        "os"
+        "strings"
+)
+
+// The update of targets is scheduled as tasks. Each task runs in it's own
+// goroutine, but only the one holding the context could evaluate rules and
+// expand recipes. The context is released only when a task waits for other
+// tasks or runs recipes, so independent targets are updated concurrently
+// while the evaluation is kept in order.
+
+var (
+        errStopped = errors.New("stopped for previous errors")
+        errPrerequisitesFailed = errors.New("prerequisites failed")
+        errCycle = errors.New("dependency cycle")
+)
+
+// task is the update of a target (or module) in an update run, it's
+// started once and shared by all dependents.
+type task struct {
+        key interface{}
+        parent *task // the task started it
+        done chan bool
+        yield chan bool // closed when the task releases the context first time
+        updated bool
+        failed bool // the task or any task it waited for failed
+        panic interface{} // the panic raised by the task
+}
+
+// ruleKey identifies the task updating a target by a rule, a grouped rule
+// is identified by it's first target.
+type ruleKey struct {
+        r *rule
+        target string
+}
+
+// prerequisiteKey identifies the task updating a prerequisite found in a
+// namespace.
+type prerequisiteKey struct {
+        ns namespace
+        target string
+}
+
+// commandKey identifies the task updating a target given in command line.
+type commandKey string
+
+// failure is a target failed to update.
+type failure struct {
+        target, location string
+        err error
+}
+
+// scope is the evaluation state of a task, it's restored whenever the task
+// acquires the context again.
+type scope struct {
+        t *task
+        m *Module
+        l *lex
+        auto map[string]Items
+        wd string
+}
+
+func (ctx *Context) saveScope() *scope {
+        wd, _ := os.Getwd()
+        return &scope{ ctx.task, ctx.m, ctx.l, ctx.auto, wd }
+}
+
+func (ctx *Context) restoreScope(s *scope) {
+        ctx.task, ctx.m, ctx.l, ctx.auto = s.t, s.m, s.l, s.auto
+        if wd, _ := os.Getwd(); s.wd != "" && s.wd != wd {
+                if err := os.Chdir(s.wd); err != nil {
+                        errorf("change working directory: %v", err)
+                }
+        }
+}
+
+// beginUpdate acquires the context and prepares an update run.
+func (ctx *Context) beginUpdate() {
+        pools := ctx.makePools()
+        ctx.mu.Lock()
+        ctx.pools = pools
+        ctx.cache = openCache()
+        if ctx.needsDatabase() {
+                ctx.db = loadDatabase(databasePath())
+        }
+        ctx.task, ctx.tasks = nil, make(map[interface{}]*task)
+        ctx.failed, ctx.failures, ctx.stop, ctx.stale = nil, nil, make(chan bool), false
+        ctx.ambiguous = nil
+        ctx.outputs = make(map[*Module]*bytes.Buffer)
+        if js, err := startJobserver(*flagJ, *flagJobserverStyle); err != nil {
+                ctx.mu.Unlock()
+                errorf("jobserver: %v", err)
+        } else {
+                jobs = js
+        }
+}
+
+// needsDatabase tells if the build database is loaded for the update, it's
+// not only for comparing recipe signatures (-db) but also for content
+// hashes (-hash), the action cache and the dependencies of depfiles.
+func (ctx *Context) needsDatabase() bool {
+        return *flagDatabase || *flagHash || ctx.cache != nil || ctx.hasDepfiles()
+}
+
+// endUpdate waits for all tasks and releases the context.
+func (ctx *Context) endUpdate() {
+        ctx.unlockWhile(ctx.wg.Wait)
+        ctx.tasks = nil
+        if *flagK && 0 < len(ctx.failures) {
+                ctx.reportFailures()
+        }
+        if err := ctx.db.save(); err != nil {
+                message("save database: %v", err)
+        }
+        ctx.db = nil
+        if err := ctx.cache.close(); err != nil {
+                message("cache: %v", err)
+        }
+        ctx.cache = nil
+        jobs.close()
+        jobs = nil
+        ctx.mu.Unlock()
+}
+
+// fail records the failure of the target and marks the current task
+// failed. The first failure stops starting new recipes unless keep going
+// (-k), targets not depending on failed ones are still updated then.
+func (ctx *Context) fail(r *rule, target string, err error) {
+        s, lineno, colno := r.getLocation()
+        target = r.qualify(ctx, target)
+        ctx.failures = append(ctx.failures, &failure{ target, fmt.Sprintf("%v:%v:%v", s, lineno, colno), err })
+        if ctx.task != nil {
+                ctx.task.failed = true
+        }
+        if ctx.failed == nil {
+                ctx.failed = err
+                if !*flagK {
+                        close(ctx.stop)
+                }
+        }
+}
+
+// reportFailures prints the summary of failed targets.
+func (ctx *Context) reportFailures() {
+        fmt.Fprintf(os.Stderr, "smart: %v target(s) failed:\n", len(ctx.failures))
+        for _, f := range ctx.failures {
+                fmt.Fprintf(os.Stderr, "%v: %v: %v\n", f.location, f.target, f.err)
+        }
+}
+
+// stopped tells if new recipes should not be started.
+func (ctx *Context) stopped() bool {
+        select {
+        case <-ctx.stop: return true
+        default: return false
+        }
+}
+
+// unlockWhile releases the context while doing f (e.g. waiting for tasks or
+// running recipes), the scope of the current task is restored afterwards.
+func (ctx *Context) unlockWhile(f func()) {
+        var y chan bool
+        s := ctx.saveScope()
+        if t := ctx.task; t != nil {
+                y, t.yield = t.yield, nil
+        }
+        ctx.mu.Unlock()
+        if y != nil {
+                close(y)
+        }
+        f()
+        ctx.mu.Lock()
+        ctx.restoreScope(s)
+}
+
+// spawn starts a task unless it's already started in the current run. The
+// new task runs immediately in the current scope until it releases the
+// context, so that tasks are evaluated in the order they're spawned.
+func (ctx *Context) spawn(key interface{}, f func() bool) *task {
+        if t, ok := ctx.tasks[key]; ok {
+                return t
+        }
+
+        t := &task{ key:key, parent:ctx.task, done:make(chan bool), yield:make(chan bool) }
+        s, y := ctx.saveScope(), t.yield
+        ctx.tasks[key] = t
+        ctx.wg.Add(1)
+        go func() {
+                defer ctx.wg.Done()
+                defer func() {
+                        t.panic = recover()
+                        close(t.done)
+                        y := t.yield
+                        t.yield, ctx.task = nil, nil
+                        ctx.mu.Unlock()
+                        if y != nil {
+                                close(y)
+                        }
+                }()
+                // The context is handed over by the spawner.
+                ctx.task, ctx.auto = t, nil
+                t.updated = f()
+        }()
+
+        <-y
+        ctx.mu.Lock()
+        ctx.restoreScope(s)
+        return t
+}
+
+// wait waits for the tasks to be done, panics raised by the tasks are
+// raised again, and failures are passed to the current task.
+func (ctx *Context) wait(ts ...*task) {
+        pending := false
+        for _, t := range ts {
+                select {
+                case <-t.done:
+                default: pending = true
+                }
+        }
+        if pending {
+                ctx.unlockWhile(func() {
+                        for _, t := range ts { <-t.done }
+                })
+        }
+        for _, t := range ts {
+                if t.panic != nil {
+                        panic(t.panic)
+                }
+                if t.failed && ctx.task != nil {
+                        ctx.task.failed = true
+                }
+        }
+}
+
+// within tells if the task is p or started by p (directly or not).
+func (t *task) within(p *task) bool {
+        for ; t != nil; t = t.parent {
+                if t == p { return true }
+        }
+        return false
+}
+
+// cycle reports the dependency cycle from the task t (an ancestor of the
+// current task) to the target being updated by the rule. The dependency is
+// dropped with a warning, or it's an error in strict mode (-strict). It
+// returns a done task in place of t.
+func (ctx *Context) cycle(r *rule, target string, t *task) *task {
+        var path []ruleKey
+        for p := ctx.task; p != nil; p = p.parent {
+                if k, ok := p.key.(ruleKey); ok {
+                        path = append([]ruleKey{ k }, path...)
+                }
+                if p == t { break }
+        }
+        names := []string{}
+        for _, k := range path {
+                names = append(names, k.target)
+        }
+        names = append(names, target)
+
+        level, s, lineno, colno := "warning", "", 0, 0
+        if *flagStrict { level = "error" }
+        if n := len(path); 0 < n {
+                s, lineno, colno = path[n-1].r.getLocation()
+        }
+        fmt.Fprintf(os.Stderr, "%v:%v:%v:%v: dependency cycle %v", s, lineno, colno, level, strings.Join(names, " -> "))
+        if *flagStrict {
+                fmt.Fprintf(os.Stderr, "\n")
+        } else {
+                fmt.Fprintf(os.Stderr, ", '%v' is dropped\n", strings.Join(names[len(names)-2:], " -> "))
+        }
+        for i, k := range path {
+                s, lineno, colno := k.r.getLocation()
+                fmt.Fprintf(os.Stderr, "%v:%v:%v: %v -> %v\n", s, lineno, colno, k.target, names[i+1])
+        }
+
+        done := &task{ key:ruleKey{ r, target }, done:make(chan bool) }
+        close(done.done)
+        if *flagStrict {
+                if n := len(path); 0 < n {
+                        r, target = path[n-1].r, path[n-1].target
+                }
+                ctx.fail(r, target, errCycle)
+                done.failed = true
+        }
+        return done
+}
+
+// updateModule updates the module in a task, it's not waited if the module
+// is being updated by the current task.
+func (ctx *Context) updateModule(m *Module) bool {
+        if t, ok := ctx.tasks[m]; ok && ctx.task.within(t) {
+                return false
+        }
+        t := ctx.spawn(m, func() bool { return m.update(ctx) })
+        ctx.wait(t)
+        return t.updated
+}
@@ -0,0 +1,174 @@
+//
+//  Copyright (C) 2012-2016, Duzy Chan <code@duzy.info>, all rights reserverd.
+//
+package smart
+
+import (
+        "os"
+        "strings"
+        "time"
+        "testing"
+        "io/ioutil"
+)
+
+func TestScheduleParallel(t *testing.T) {
+        if wd, e := os.Getwd(); e != nil || workdir != wd { t.Errorf("%v != %v (%v)", workdir, wd, e) }
+
+        defer SetFlagJ(GetFlagJ())
+        SetFlagJ(2)
+
+        ctx, err := newTestContext("TestScheduleParallel", `
+all: a.out b.out
+%.out: c.txt
+	@sleep 0.5; echo $@ $^ > $@
+c.txt:
+	@echo c >> $@
+`);     if err != nil { t.Errorf("parse error: %v", err) }
+
+        os.Remove("a.out")
+        os.Remove("b.out")
+        os.Remove("c.txt")
+
+        start := time.Now()
+        Update(ctx)
+        if d := time.Since(start); d > 900*time.Millisecond {
+                t.Errorf("not run in parallel: %v", d)
+        }
+        if b, e := ioutil.ReadFile("a.out"); e != nil { t.Errorf("%v", e) } else {
+                if s, x := string(b), "a.out c.txt\n"; s != x { t.Errorf("'%v' != '%v'", s, x) }
+        }
+        if b, e := ioutil.ReadFile("b.out"); e != nil { t.Errorf("%v", e) } else {
+                if s, x := string(b), "b.out c.txt\n"; s != x { t.Errorf("'%v' != '%v'", s, x) }
+        }
+        if b, e := ioutil.ReadFile("c.txt"); e != nil { t.Errorf("%v", e) } else {
+                if s, x := string(b), "c\n"; s != x { t.Errorf("'%v' != '%v' (updated more than once)", s, x) }
+        }
+
+        os.Remove("a.out")
+        os.Remove("b.out")
+        os.Remove("c.txt")
+}
+
+func TestScheduleStopOnFailure(t *testing.T) {
+        if wd, e := os.Getwd(); e != nil || workdir != wd { t.Errorf("%v != %v (%v)", workdir, wd, e) }
+
+        defer SetFlagJ(GetFlagJ())
+        SetFlagJ(2)
+
+        ctx, err := newTestContext("TestScheduleStopOnFailure", `
+all: bad.txt foo.txt
+bad.txt:
+	@sleep 0.1; false
+foo.txt: bar.txt
+	@touch $@
+bar.txt:
+	@sleep 0.3; touch $@
+`);     if err != nil { t.Errorf("parse error: %v", err) }
+
+        os.Remove("foo.txt")
+        os.Remove("bar.txt")
+        Update(ctx)
+        if _, e := os.Stat("bar.txt"); e != nil { t.Errorf("running recipe is not finished: %v", e) }
+        if _, e := os.Stat("foo.txt"); e == nil { t.Errorf("foo.txt is updated after failure") }
+        if ctx.failed == nil { t.Errorf("failure is not recorded") }
+
+        os.Remove("foo.txt")
+        os.Remove("bar.txt")
+}
+
+func TestScheduleKeepGoing(t *testing.T) {
+        if wd, e := os.Getwd(); e != nil || workdir != wd { t.Errorf("%v != %v (%v)", workdir, wd, e) }
+
+        defer SetFlagK(GetFlagK())
+        SetFlagK(true)
+
+        ctx, err := newTestContext("TestScheduleKeepGoing", `
+all:!: a.txt b.txt c.txt
+	@touch all.txt
+a.txt: bad.txt
+	@touch $@
+bad.txt:
+	@false
+b.txt:
+	@touch $@
+c.txt: missing.txt
+	@touch $@
+`);     if err != nil { t.Errorf("parse error: %v", err) }
+
+        for _, s := range []string{ "all.txt", "a.txt", "b.txt", "c.txt" } {
+                os.Remove(s)
+                defer os.Remove(s)
+        }
+        s := captureStderr(func() { Update(ctx) })
+        if _, e := os.Stat("b.txt"); e != nil { t.Errorf("b.txt is not updated: %v", e) }
+        for _, s := range []string{ "all.txt", "a.txt", "c.txt" } {
+                if _, e := os.Stat(s); e == nil { t.Errorf("%v is updated after failure", s) }
+        }
+        if ctx.failed == nil { t.Errorf("failure is not recorded") }
+        if n := len(ctx.failures); n != 2 { t.Errorf("failures: %v", n) }
+        for _, x := range []string{
+                "smart: 2 target(s) failed:\n",
+                "TestScheduleKeepGoing:6:1: bad.txt: exit status 1\n",
+                "TestScheduleKeepGoing:10:1: c.txt: no rule to update 'missing.txt'\n",
+        } {
+                if !strings.Contains(s, x) { t.Errorf("missing '%v' in:\n%v", x, s) }
+        }
+}
+
+func TestScheduleCycle(t *testing.T) {
+        if wd, e := os.Getwd(); e != nil || workdir != wd { t.Errorf("%v != %v (%v)", workdir, wd, e) }
+
+        defer SetFlagStrict(GetFlagStrict())
+
+        ctx, err := newTestContext("TestScheduleCycle", `
+a.txt: b.txt
+	@touch $@
+b.txt: c.txt
+	@touch $@
+c.txt: a.txt
+	@touch $@
+all:!: a.txt
+`);     if err != nil { t.Errorf("parse error: %v", err) }
+
+        update := func(target string) (s string) {
+                done := make(chan bool)
+                go func() {
+                        defer close(done)
+                        s = captureStderr(func() { Update(ctx, target) })
+                }()
+                select {
+                case <-done:
+                case <-time.After(5*time.Second): t.Fatalf("deadlock")
+                }
+                return
+        }
+
+        names := []string{ "a.txt", "b.txt", "c.txt" }
+        for _, s := range names { os.Remove(s); defer os.Remove(s) }
+
+        s := update("a.txt")
+        if x := "TestScheduleCycle:6:1:warning: dependency cycle a.txt -> b.txt -> c.txt -> a.txt, 'c.txt -> a.txt' is dropped\n" +
+                "TestScheduleCycle:2:1: a.txt -> b.txt\n" +
+                "TestScheduleCycle:4:1: b.txt -> c.txt\n" +
+                "TestScheduleCycle:6:1: c.txt -> a.txt\n"; s != x { t.Errorf("'%v' != '%v'", s, x) }
+        for _, s := range names {
+                if _, e := os.Stat(s); e != nil { t.Errorf("%v", e) }
+                os.Remove(s)
+        }
+
+        SetFlagStrict(true)
+        s = update("a.txt")
+        if x := "TestScheduleCycle:6:1:error: dependency cycle a.txt -> b.txt -> c.txt -> a.txt\n"; !strings.HasPrefix(s, x) { t.Errorf("'%v' != '%v'", s, x) }
+        for _, s := range names {
+                if _, e := os.Stat(s); e == nil { t.Errorf("%v is updated", s) }
+        }
+        if ctx.failed != errCycle { t.Errorf("failure: %v", ctx.failed) }
+
+        // Also reached through the prerequisites of a phony target.
+        SetFlagStrict(false)
+        s = update("all")
+        if x := "TestScheduleCycle:6:1:warning: dependency cycle a.txt -> b.txt -> c.txt -> a.txt, 'c.txt -> a.txt' is dropped\n"; !strings.HasPrefix(s, x) { t.Errorf("'%v' != '%v'", s, x) }
+        for _, s := range names {
+                if _, e := os.Stat(s); e != nil { t.Errorf("%v", e) }
+        }
+}
@@ -12,6 +12,7 @@ package smart
 import (
         "flag"
         "fmt"
+        "os"
         "strings"
 )
 
@@ -20,7 +21,7 @@ var (
         flagM = flag.Bool("m", false, "searching module for targets")
         flagG = flag.Bool("g", false, "searching global targets")
         flagGG = flag.Bool("G", true, "ignore names like \".git\", \".svn\", etc.")
-        flagJ = flag.Int("j", 3, "Allow N jobs at once.")
+        flagJ = flag.Int("j", 1, "Allow N jobs at once.")
         flagO = flag.String("o", "", "output directory")
         flagC = flag.String("C", "", "change directory")
         flagT = flag.String("T", "", "traverse")
@@ -28,6 +29,23 @@ var (
         flagVV= flag.Bool("V", false, "print command verbosely")
         flagW = flag.Bool("w", false, "warn undefined symbols")
         flagL = flag.Bool("l", false, "warn undefined symbols")
+        flagDeleteOnError = flag.Bool("delete-on-error", false, "delete targets of failed recipes, like .DELETE_ON_ERROR")
+        flagJobserverStyle = flag.String("jobserver-style", "pipe", "the jobserver passed to children: pipe or fifo")
+        flagLoadAverage = flag.Float64("load-average", 0, "don't start new jobs if the load average is not below N")
+        flagHash = flag.Bool("hash", false, "check if targets are up to date by content hashes")
+        flagDatabase = flag.Bool("db", false, "update targets if commands are changed, by keeping them in .smart.db")
+        flagD = flag.Bool("d", false, "print reasons of updating targets")
+        flagExplain = flag.Bool("explain", false, "print rules matched, and why targets are updated or not")
+        flagCache = flag.String("cache", "", "restore targets from the cache directory (also SMART_CACHE)")
+        flagRemoteCache = flag.String("remote-cache", "", "share the cache with the HTTP cache server (also SMART_REMOTE_CACHE)")
+        flagCacheSize = flag.Int64("cache-size", 5120, "maximum size of the cache in megabytes")
+        flagHermetic = flag.Bool("hermetic", false, "check that recipes only write their declared targets")
+        flagStrict = flag.Bool("strict", false, "treat violations (e.g. of -hermetic) as errors")
+        flagK = flag.Bool("k", false, "keep going when some targets can't be updated")
+        flagN = flag.Bool("n", false, "print the recipes that would be executed, but don't execute them")
+        flagQ = flag.Bool("q", false, "run nothing but '+' recipes, exit 0 if targets are up to date, otherwise 1")
+        flagTouch = flag.Bool("t", false, "touch targets instead of updating them")
+        flagOutputSync = flag.String("output-sync", "none", "synchronize outputs of parallel jobs: none, line, target or recurse")
 )
 
 func GetFlagA() bool    { return *flagA }
@@ -41,6 +59,23 @@ func GetFlagT() string  { return *flagT }
 func GetFlagL() bool    { return *flagL }
 func GetFlagV() bool    { return *flagV }
 func GetFlagVV() bool   { return *flagVV }
+func GetFlagDeleteOnError() bool { return *flagDeleteOnError }
+func GetFlagOutputSync() string { return *flagOutputSync }
+func GetFlagJobserverStyle() string { return *flagJobserverStyle }
+func GetFlagLoadAverage() float64 { return *flagLoadAverage }
+func GetFlagHash() bool { return *flagHash }
+func GetFlagDatabase() bool { return *flagDatabase }
+func GetFlagD() bool    { return *flagD }
+func GetFlagExplain() bool { return *flagExplain }
+func GetFlagCache() string { return *flagCache }
+func GetFlagCacheSize() int64 { return *flagCacheSize }
+func GetFlagRemoteCache() string { return *flagRemoteCache }
+func GetFlagK() bool    { return *flagK }
+func GetFlagN() bool    { return *flagN }
+func GetFlagQ() bool    { return *flagQ }
+func GetFlagTouch() bool { return *flagTouch }
+func GetFlagHermetic() bool { return *flagHermetic }
+func GetFlagStrict() bool { return *flagStrict }
 
 func SetFlagA(v bool)   { *flagA = v }
 func SetFlagM(v bool)   { *flagM = v }
@@ -53,6 +88,23 @@ func SetFlagT(v string) { *flagT = v }
 func SetFlagL(v bool)   { *flagL = v }
 func SetFlagV(v bool)   { *flagV = v }
 func SetFlagVV(v bool)  { *flagVV = v }
+func SetFlagDeleteOnError(v bool) { *flagDeleteOnError = v }
+func SetFlagOutputSync(v string) { *flagOutputSync = v }
+func SetFlagJobserverStyle(v string) { *flagJobserverStyle = v }
+func SetFlagLoadAverage(v float64) { *flagLoadAverage = v }
+func SetFlagHash(v bool) { *flagHash = v }
+func SetFlagDatabase(v bool) { *flagDatabase = v }
+func SetFlagD(v bool)   { *flagD = v }
+func SetFlagExplain(v bool) { *flagExplain = v }
+func SetFlagCache(v string) { *flagCache = v }
+func SetFlagCacheSize(v int64) { *flagCacheSize = v }
+func SetFlagRemoteCache(v string) { *flagRemoteCache = v }
+func SetFlagK(v bool)   { *flagK = v }
+func SetFlagN(v bool)   { *flagN = v }
+func SetFlagQ(v bool)   { *flagQ = v }
+func SetFlagTouch(v bool) { *flagTouch = v }
+func SetFlagHermetic(v bool) { *flagHermetic = v }
+func SetFlagStrict(v bool) { *flagStrict = v }
 
 type smarterror struct {
         message string
@@ -79,6 +131,13 @@ func errorf(f string, a ...interface{}) {
         panic(&smarterror{ fmt.Sprintf(f, a...) })
 }
 
+// debug prints a message if `d' flag is enabled
+func debug(s string, a ...interface{}) {
+        if *flagD {
+                message(s, a...)
+        }
+}
+
 // verbose prints a message if `V' flag is enabled
 func verbose(s string, a ...interface{}) {
         if *flagVV {
@@ -133,7 +192,23 @@ func Main() {
 
         if 0 == len(cmds) {
                 cmds = append(cmds, "update")
+        } else if cmds[0] == "cache" || cmds[0] == "cache-server" {
+                var err error
+                if cmds[0] == "cache" {
+                        err = cacheCommand(os.Stdout, cmds[1:])
+                } else {
+                        err = cacheServerCommand(cmds[1:])
+                }
+                if err != nil {
+                        fmt.Printf("smart: %v\n", err)
+                        os.Exit(-1)
+                }
+                return
         }
 
-        Build(vars, cmds...)
+        if ctx := Build(vars, cmds...); ctx != nil && ctx.failed != nil {
+                os.Exit(2)
+        } else if *flagQ && ctx != nil && ctx.stale {
+                os.Exit(1)
+        }
 }
@@ -0,0 +1,118 @@
+//
+//  Copyright (C) 2012-2016, Duzy Chan <code@duzy.info>, all rights reserverd.
+//
+package smart
+
+import (
+        "path/filepath"
+        "strings"
+)
+
+// Prerequisites not found in the working directory are searched in the
+// directories of `vpath pattern dirs` directives whose pattern matches, and
+// then in the directories of the module variable `me.vpath` and the global
+// `VPATH`. Directories are separated by spaces or `:`. Like GNU make,
+// `vpath pattern` clears the directives of the pattern, and `vpath` clears
+// all of them.
+//
+//      VPATH = src
+//      vpath %.h include
+//      foo.o: foo.c foo.h      # $^ is "src/foo.c include/foo.h"
+
+// vpath is a `vpath pattern dirs` directive.
+type vpath struct {
+        pattern string
+        dirs []string
+}
+
+// match tells if the name matches the pattern of the directive.
+func (vp *vpath) match(name string) bool {
+        if strings.Contains(vp.pattern, "%") {
+                _, ok := matchPercent(vp.pattern, name)
+                return ok
+        }
+        return vp.pattern == name
+}
+
+// splitSearchPath splits directories separated by spaces or `:`.
+func splitSearchPath(s string) []string {
+        return strings.FieldsFunc(s, func(r rune) bool {
+                return r == ':' || r == filepath.ListSeparator || r == ' ' || r == '\t' || r == '\n'
+        })
+}
+
+func processNodeVpath(ctx *Context, n *node) (err error) {
+        var ns *namespaceEmbed
+        if ctx.m == nil {
+                ns = ctx.g
+        } else {
+                ns = ctx.m.namespaceEmbed
+        }
+
+        var args []string
+        for _, s := range ctx.ItemsStrings(ctx.nodesItems(n.children...)...) {
+                args = append(args, Split(s)...)
+        }
+        switch len(args) {
+        case 0:
+                ns.vpaths = nil
+        case 1:
+                var vpaths []*vpath
+                for _, vp := range ns.vpaths {
+                        if vp.pattern != args[0] {
+                                vpaths = append(vpaths, vp)
+                        }
+                }
+                ns.vpaths = vpaths
+        default:
+                var dirs []string
+                for _, s := range args[1:] {
+                        dirs = append(dirs, splitSearchPath(s)...)
+                }
+                ns.vpaths = append(ns.vpaths, &vpath{ args[0], dirs })
+        }
+        return
+}
+
+// searchDirs returns the directories to search for the name.
+func (r *rule) searchDirs(ctx *Context, name string) (dirs []string) {
+        var namespaces []*namespaceEmbed
+        if m := r.module; m != nil {
+                namespaces = append(namespaces, m.namespaceEmbed)
+        }
+        namespaces = append(namespaces, ctx.g)
+        for _, ns := range namespaces {
+                for _, vp := range ns.vpaths {
+                        if vp.match(name) {
+                                dirs = append(dirs, vp.dirs...)
+                        }
+                }
+        }
+        if m := r.module; m != nil {
+                dirs = append(dirs, splitSearchPath(m.Get(ctx, "vpath"))...)
+        }
+        if d, ok := ctx.g.defines["VPATH"]; ok && d != nil {
+                dirs = append(dirs, splitSearchPath(d.value.Expand(ctx))...)
+        }
+        return
+}
+
+// searchFile returns the path of the file, it's the name if the file exists
+// in the working directory, or the first one found in the search
+// directories. Absolute names are not searched.
+func (r *rule) searchFile(ctx *Context, name string) (path string, found bool) {
+        if _, err := statFile(name); err == nil {
+                return name, true
+        }
+        if filepath.IsAbs(name) {
+                return name, false
+        }
+        for _, dir := range r.searchDirs(ctx, name) {
+                if path = filepath.Join(dir, name); path != name {
+                        if _, err := statFile(path); err == nil {
+                                return path, true
+                        }
+                }
+        }
+        return name, false
+}
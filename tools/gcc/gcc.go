@@ -19,13 +19,18 @@ var hc = MustHookup(
         `# Build GCC Projects
 template gcc
 
+# Header dependencies are generated by the compiler, only for objects.
+me.depfile = $@.d
+
 post
 
+.DEPFILES: %.o
+
 $(me.name): $(gcc:objects)
 	@echo "todo: $^ -> $(me.name) ($(me.workdir))"
 
-%.o: %.c   ; gcc -o $@ $<
-%.o: %.cpp ; g++ -o $@ $<
+%.o: %.c   ; gcc -MMD -MF $@.d -o $@ $<
+%.o: %.cpp ; g++ -MMD -MF $@.d -o $@ $<
 
 commit
 `)